@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spy16/genie"
+)
+
+func listItems(ctx context.Context, q genie.Queue, args []string) error {
+	var query genie.Query
+	var asJSON bool
+
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.StringVar(&query.GroupID, "group", "", "Only items in this group")
+	fs.StringVar(&query.Type, "type", "", "Only items of this type")
+	fs.StringVar(&query.Status, "status", "", "Only items with this status")
+	fs.StringVar(&query.IDPrefix, "prefix", "", "Only items with ID starting with this")
+	fs.StringVar(&query.ErrorContains, "error", "", "Only items with last error containing this")
+	fs.StringVar(&query.SortBy, "sort", genie.SortCreatedAt, "Sort by created_at, updated_at or id")
+	fs.BoolVar(&query.Desc, "desc", false, "Sort in descending order")
+	fs.IntVar(&query.Limit, "limit", 100, "Maximum items to list")
+	fs.StringVar(&query.Cursor, "cursor", "", "Cursor printed by previous list to fetch next page")
+	fs.BoolVar(&asJSON, "json", false, "Print items as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	page, err := q.List(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, item := range page.Items {
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tGROUP\tSTATUS\tATTEMPTS\tUPDATED\tLAST ERROR")
+		for _, item := range page.Items {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\n", item.ID, item.Type, item.GroupID, item.Status,
+				item.Attempt, item.MaxAttempts, item.UpdatedAt.Format("2006-01-02 15:04:05"), truncate(item.LastError, 60))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if page.NextCursor != "" {
+		fmt.Fprintf(os.Stderr, "more items available, use -cursor=%s\n", page.NextCursor)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	for i, r := range s {
+		if r == '\n' || i >= n {
+			return s[:i] + "..."
+		}
+	}
+	return s
+}
@@ -2,47 +2,115 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spy16/genie"
 )
 
 var (
-	bindAddr  = flag.String("bind", "0.0.0.0:9090", "Bind address for portal")
-	jobTypes  = flag.String("types", "log,webhook", "Job types to enable")
-	queueSpec = flag.String("spec", "sqlite3://genie.db", "Queue backend specification")
+	bindAddr     = flag.String("bind", "0.0.0.0:9090", "Bind address for portal")
+	jobTypes     = flag.String("types", "log,webhook", "Job types to enable")
+	queueSpec    = flag.String("spec", "sqlite3://genie.db", "Queue backend specification")
+	drainTimeout = flag.Duration("drain", 10*time.Second, "Time allowed for in-flight jobs to finish on shutdown")
+	enableSearch = flag.Bool("search", false, "Enable full-text search (requires build with '-tags sqlite_fts5')")
+	dropSearch   = flag.Bool("drop-search", false, "Stop maintaining the full-text search index for all processes")
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [serve|list|schedules|pause|resume] [command flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	q, err := genie.Open(*queueSpec, strings.Split(*jobTypes, ","), genie.HandlerFn(logFn))
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	opts := []genie.Option{genie.DrainTimeout(*drainTimeout)}
+	if *enableSearch {
+		opts = append(opts, genie.EnableSearch())
+	} else if *dropSearch {
+		opts = append(opts, genie.DropSearch())
+	}
+
+	q, err := genie.Open(*queueSpec, strings.Split(*jobTypes, ","), genie.HandlerFn(logFn), opts...)
 	if err != nil {
 		fmt.Printf("failed to open file: %v\n", err)
 		os.Exit(1)
 	}
 	defer q.Close()
 
+	var args []string
+	if flag.NArg() > 1 {
+		args = flag.Args()[1:]
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve(ctx, q)
+
+	case "list":
+		err = listItems(ctx, q, args)
+
+	case "schedules":
+		err = manageSchedules(ctx, q, args)
+
+	case "pause":
+		err = pause(ctx, q, args)
+
+	case "resume":
+		err = resume(ctx, q, args)
+
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		q.Close()
+		os.Exit(1)
+	}
+}
+
+func serve(ctx context.Context, q genie.Queue) {
+	runDone := make(chan struct{})
 	go func() {
-		if err := q.Run(context.Background()); err != nil {
+		defer close(runDone)
+		if err := q.Run(ctx); err != nil {
 			log.Printf("queue.Run() exited: %v", err)
 		}
 	}()
 
+	srv := &http.Server{Addr: *bindAddr, Handler: genie.Router(q)}
+	go func() {
+		<-ctx.Done()
+		log.Println("shutting down...")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Printf("portal shutdown failed: %v", err)
+		}
+	}()
+
 	log.Printf("starting server on http://%s...", *bindAddr)
-	if err := http.ListenAndServe(*bindAddr, genie.Router(q)); err != nil {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("portal exited with error: %v", err)
 	} else {
 		log.Println("portal exited gracefully")
 	}
+
+	<-runDone
+	log.Println("queue drained")
 }
 
 func logFn(ctx context.Context, item genie.Item) ([]byte, error) {
-	log.Printf("apply(%v)", item)
+	genie.Logger(ctx).Printf("apply(%v)", item)
 	return nil, nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spy16/genie"
+)
+
+// pause pauses the type or group given by the flags, or lists the current
+// pauses if neither is given.
+func pause(ctx context.Context, q genie.Queue, args []string) error {
+	var p genie.Pause
+
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	fs.StringVar(&p.Type, "type", "", "Type of items to pause")
+	fs.StringVar(&p.GroupID, "group", "", "Group of items to pause")
+	fs.StringVar(&p.Reason, "reason", "", "Reason for the pause, shown in the portal")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if p.Type == "" && p.GroupID == "" {
+		return listPauses(ctx, q)
+	}
+	return q.Pause(ctx, p)
+}
+
+// resume lifts the pause of the type or group given by the flags.
+func resume(ctx context.Context, q genie.Queue, args []string) error {
+	var p genie.Pause
+
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	fs.StringVar(&p.Type, "type", "", "Type of items to resume")
+	fs.StringVar(&p.GroupID, "group", "", "Group of items to resume")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return q.Resume(ctx, p)
+}
+
+func listPauses(ctx context.Context, q genie.Queue) error {
+	pauses, err := q.Pauses(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tGROUP\tPAUSED AT\tREASON")
+	for _, p := range pauses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Type, p.GroupID, p.PausedAt.Format("2006-01-02 15:04"),
+			truncate(p.Reason, 60))
+	}
+	return tw.Flush()
+}
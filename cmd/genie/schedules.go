@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spy16/genie"
+)
+
+func manageSchedules(ctx context.Context, q genie.Queue, args []string) error {
+	var sub string
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+
+	switch sub {
+	case "", "list":
+		return listSchedules(ctx, q, args)
+
+	case "add":
+		return addSchedule(ctx, q, args)
+
+	case "rm":
+		if len(args) == 0 {
+			return errors.New("schedule id is required")
+		}
+		for _, id := range args {
+			if err := q.DeleteSchedule(ctx, id); err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown schedules command '%s' (list, add or rm)", sub)
+	}
+}
+
+func listSchedules(ctx context.Context, q genie.Queue, args []string) error {
+	var asJSON bool
+
+	fs := flag.NewFlagSet("schedules list", flag.ExitOnError)
+	fs.BoolVar(&asJSON, "json", false, "Print schedules as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	schedules, err := q.Schedules(ctx)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, s := range schedules {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCRON\tTIMEZONE\tTYPE\tGROUP\tNEXT RUN\tLAST ERROR")
+	for _, s := range schedules {
+		next := s.NextRunAt.Format("2006-01-02 15:04")
+		if s.Disabled {
+			next = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Cron, s.Timezone, s.Type, s.GroupID,
+			next, truncate(s.LastError, 60))
+	}
+	return tw.Flush()
+}
+
+func addSchedule(ctx context.Context, q genie.Queue, args []string) error {
+	var s genie.Schedule
+	var missedRuns string
+
+	fs := flag.NewFlagSet("schedules add", flag.ExitOnError)
+	fs.StringVar(&s.ID, "id", "", "Schedule ID, replaces the existing schedule with same ID")
+	fs.StringVar(&s.Cron, "cron", "", "Cron expression, e.g. '0 9 * * mon-fri' or '@daily'")
+	fs.StringVar(&s.Timezone, "tz", "UTC", "Timezone of the cron expression")
+	fs.StringVar(&s.Type, "type", "", "Type of items to enqueue")
+	fs.StringVar(&s.Payload, "payload", "", "Payload template of the items")
+	fs.StringVar(&s.GroupID, "group", "", "Group ID template of the items (defaults to schedule ID)")
+	fs.StringVar(&missedRuns, "missed", string(genie.MissedRunSkip), "Missed runs policy, 'skip' or 'catch_up'")
+	fs.BoolVar(&s.Disabled, "disabled", false, "Add the schedule disabled")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s.MissedRuns = genie.MissedRunPolicy(missedRuns)
+
+	saved, err := q.PutSchedule(ctx, s)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schedule '%s' saved, next run at %s\n", saved.ID, saved.NextRunAt.Format("2006-01-02 15:04:05"))
+	return nil
+}
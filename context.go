@@ -0,0 +1,42 @@
+package genie
+
+import (
+	"context"
+	"time"
+)
+
+// drainContext returns a context that carries the values of parent but
+// is cancelled only once timeout has elapsed after parent is cancelled.
+func drainContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(detach(parent))
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-parent.Done():
+		}
+
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+			cancel()
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// detach returns a context that carries the values of parent but is never
+// cancelled and has no deadline.
+func detach(parent context.Context) context.Context { return detachedCtx{parent: parent} }
+
+type detachedCtx struct{ parent context.Context }
+
+func (detachedCtx) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedCtx) Done() <-chan struct{}               { return nil }
+func (detachedCtx) Err() error                          { return nil }
+func (d detachedCtx) Value(key interface{}) interface{} { return d.parent.Value(key) }
@@ -0,0 +1,80 @@
+package genie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *testing.T) {
+	ist, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+
+	from := time.Date(2021, 6, 15, 10, 30, 15, 0, time.UTC) // tuesday.
+
+	table := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{expr: "* * * * *", from: from, want: time.Date(2021, 6, 15, 10, 31, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", from: from, want: time.Date(2021, 6, 15, 10, 45, 0, 0, time.UTC)},
+		{expr: "0 9-17/4 * * *", from: from, want: time.Date(2021, 6, 15, 13, 0, 0, 0, time.UTC)},
+		{expr: "5,10 0 * * *", from: from, want: time.Date(2021, 6, 16, 0, 5, 0, 0, time.UTC)},
+		{expr: "0 0 1 jan *", from: from, want: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 12 * * sat,sun", from: from, want: time.Date(2021, 6, 19, 12, 0, 0, 0, time.UTC)},
+		{expr: "0 12 * * 7", from: from, want: time.Date(2021, 6, 20, 12, 0, 0, 0, time.UTC)},
+		{expr: "0 0 13 * fri", from: from, want: time.Date(2021, 6, 18, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", from: from, want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 30 2 *", from: from, want: time.Time{}},
+		{expr: "@daily", from: from.In(ist), want: time.Date(2021, 6, 16, 0, 0, 0, 0, ist)},
+		{expr: "@hourly", from: from, want: time.Date(2021, 6, 15, 11, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.expr, func(t *testing.T) {
+			spec, err := parseCron(tt.expr)
+			require.NoError(t, err)
+			assert.True(t, tt.want.Equal(spec.next(tt.from)), "got %s", spec.next(tt.from))
+		})
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * * * *", "5-1 * * * *", "*/0 * * * *", "@never", "* * * foo *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCompiledSchedule_dueRuns(t *testing.T) {
+	now := time.Date(2021, 6, 15, 10, 30, 15, 0, time.UTC)
+	after := now.AddDate(-1, 0, 0) // a long outage.
+
+	for _, expr := range []string{"* * * * *", "*/5 9-17 * * mon-fri"} {
+		t.Run(expr, func(t *testing.T) {
+			s := Schedule{ID: "s", Cron: expr, Type: "test"}
+			cs, err := s.compile()
+			require.NoError(t, err)
+			last := cs.runs(now.Add(-3*24*time.Hour), now, 0)
+			latest := last[len(last)-1]
+
+			runs, next := cs.dueRuns(s, after, now)
+			require.Len(t, runs, 1)
+			assert.True(t, latest.Equal(runs[0]), "got %s", runs[0])
+			assert.True(t, cs.next(now).Equal(next))
+
+			s.MissedRuns = MissedRunCatchUp
+			runs, _ = cs.dueRuns(s, after, now)
+			require.Len(t, runs, maxCatchUp)
+			assert.True(t, latest.Equal(runs[len(runs)-1]))
+			for i := 1; i < len(runs); i++ {
+				assert.True(t, cs.next(runs[i-1]).Equal(runs[i]), "missing run before %s", runs[i])
+			}
+
+			// runs before after are never returned.
+			runs, _ = cs.dueRuns(s, latest.Add(-time.Second), now)
+			assert.Len(t, runs, 1)
+		})
+	}
+}
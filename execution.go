@@ -0,0 +1,205 @@
+package genie
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type ctxKey int
+
+const executionKey ctxKey = iota
+
+// execution holds the state of an item being executed by a worker and is
+// carried by the context passed to Handle.
+type execution struct {
+	itemID  string
+	attempt int
+	logs    *limitedBuffer
+	logger  *log.Logger
+
+	// progress reports are persisted using saveProgress at most once
+	// every progressInt. The latest report is always retained.
+	mu           sync.Mutex
+	progress     *Progress
+	progressInt  time.Duration
+	lastSaved    time.Time
+	saveProgress func(ctx context.Context, p Progress) error
+
+	// saveCheckpoint persists the handler state with the item.
+	saveCheckpoint func(ctx context.Context, state []byte) error
+
+	// children spawned are validated using prepareChildren and are stored
+	// with the outcome of the attempt. childSeq numbers the children that
+	// have no ID.
+	children        []Item
+	childSeq        int
+	prepareChildren func(ctx context.Context, items []Item) ([]Item, error)
+}
+
+func newExecution(item Item, opts Options) *execution {
+	buf := &limitedBuffer{limit: opts.MaxLogSize}
+	return &execution{
+		itemID:      item.ID,
+		attempt:     item.Attempt + 1,
+		logs:        buf,
+		logger:      log.New(buf, "", log.LstdFlags|log.Lmicroseconds),
+		progressInt: opts.ProgressInterval,
+		childSeq:    len(item.Children),
+	}
+}
+
+func withExecution(ctx context.Context, exec *execution) context.Context {
+	return context.WithValue(ctx, executionKey, exec)
+}
+
+func executionFrom(ctx context.Context) *execution {
+	exec, _ := ctx.Value(executionKey).(*execution)
+	return exec
+}
+
+// Logger returns a logger whose output is stored with the current attempt
+// of the item being handled. If ctx is not from a handler invocation, the
+// standard logger is returned.
+func Logger(ctx context.Context) *log.Logger {
+	if exec := executionFrom(ctx); exec != nil {
+		return exec.logger
+	}
+	return log.Default()
+}
+
+// Progress is the completion status reported by a handler.
+type Progress struct {
+	Fraction float64 `json:"fraction"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// ReportProgress records the fraction (0 to 1) of work completed for the
+// item being handled along with a message. Reports are persisted at most
+// once every ProgressInterval, except for completion (fraction 1), and the
+// latest report is persisted with the outcome of the attempt. Does nothing
+// if ctx is not from a handler invocation.
+func ReportProgress(ctx context.Context, fraction float64, message string) error {
+	exec := executionFrom(ctx)
+	if exec == nil {
+		return nil
+	}
+
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	p := Progress{Fraction: fraction, Message: message}
+
+	exec.mu.Lock()
+	defer exec.mu.Unlock()
+
+	exec.progress = &p
+	if exec.saveProgress == nil || (fraction < 1 && time.Since(exec.lastSaved) < exec.progressInt) {
+		return nil
+	}
+	exec.lastSaved = time.Now()
+	return exec.saveProgress(ctx, p)
+}
+
+// Checkpoint persists state with the item being handled so that later
+// attempts can resume from it using Item.Checkpoint. Each call replaces
+// the previously saved state, and a nil state clears it. Returns
+// ErrInvalidStatus if the item is no longer running on this worker (e.g.,
+// it was cancelled). Does nothing if ctx is not from a handler invocation.
+func Checkpoint(ctx context.Context, state []byte) error {
+	exec := executionFrom(ctx)
+	if exec == nil || exec.saveCheckpoint == nil {
+		return nil
+	}
+	return exec.saveCheckpoint(ctx, state)
+}
+
+// Spawn enqueues child items of the item being handled. Children without
+// an ID are assigned '<parent-id>.<n>' and those without a group inherit
+// the group of the parent. Children are validated immediately, but are
+// pushed only if the handler returns successfully, in which case the item
+// moves to WAITING. Once all the children are finished, the item is
+// invoked again with their outcomes in Item.Children and its attempts
+// reset. Cancelling the waiting item cancels its unfinished children.
+// Children whose ID already exists are ignored. Returns error if ctx is
+// not from a handler invocation.
+func Spawn(ctx context.Context, items ...Item) error {
+	exec := executionFrom(ctx)
+	if exec == nil || exec.prepareChildren == nil {
+		return errors.New("spawn is only allowed from a handler")
+	}
+
+	items = append([]Item(nil), items...)
+	exec.mu.Lock()
+	for i := range items {
+		if items[i].ID == "" {
+			exec.childSeq++
+			items[i].ID = fmt.Sprintf("%s.%d", exec.itemID, exec.childSeq)
+		}
+	}
+	exec.mu.Unlock()
+
+	children, err := exec.prepareChildren(ctx, items)
+	if err != nil {
+		return err
+	}
+
+	exec.mu.Lock()
+	defer exec.mu.Unlock()
+	exec.children = append(exec.children, children...)
+	return nil
+}
+
+// spawned returns the children spawned so far.
+func (exec *execution) spawned() []Item {
+	exec.mu.Lock()
+	defer exec.mu.Unlock()
+	return exec.children
+}
+
+// latestProgress returns the last progress reported, if any.
+func (exec *execution) latestProgress() *Progress {
+	exec.mu.Lock()
+	defer exec.mu.Unlock()
+	return exec.progress
+}
+
+// limitedBuffer is a concurrency-safe buffer that retains at most limit
+// bytes and discards the rest.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if room := lb.limit - lb.buf.Len(); room < len(p) {
+		lb.truncated = true
+		if room > 0 {
+			lb.buf.Write(p[:room])
+		}
+	} else {
+		lb.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (lb *limitedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.truncated {
+		return lb.buf.String() + "\n... (truncated)"
+	}
+	return lb.buf.String()
+}
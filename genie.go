@@ -7,7 +7,8 @@ import (
 
 // Open opens a queue based on the spec and returns it. If the keys/tables
 // required for the queue are not present, they will be created as needed.
-func Open(queueSpec string, enableTypes []string, h Handler) (Queue, error) {
+// Options can be provided to override the default queue configurations.
+func Open(queueSpec string, enableTypes []string, h Handler, opts ...Option) (Queue, error) {
 	u, err := url.Parse(queueSpec)
 	if err != nil {
 		return nil, err
@@ -15,7 +16,7 @@ func Open(queueSpec string, enableTypes []string, h Handler) (Queue, error) {
 
 	switch u.Scheme {
 	case "sqlite3":
-		return newSQLQueue(u, enableTypes, h)
+		return newSQLQueue(u, enableTypes, h, opts...)
 
 	default:
 		return nil, fmt.Errorf("unknown queue type '%s'", u.Scheme)
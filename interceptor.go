@@ -0,0 +1,47 @@
+package genie
+
+import (
+	"context"
+	"fmt"
+)
+
+// Interceptor is applied to every item being pushed onto the queue before it
+// is sanitized and stored. It can normalise the item, assign ID, schedule,
+// expand it into multiple items or reject it by returning an error. Returning
+// no items and no error drops the item.
+type Interceptor func(ctx context.Context, item Item) ([]Item, error)
+
+// Intercept adds interceptors to be applied on every push. Interceptors run
+// in the given order and each sees the items produced by the previous one.
+func Intercept(ics ...Interceptor) Option {
+	return func(opts *Options) { opts.Interceptors = append(opts.Interceptors, ics...) }
+}
+
+// AssignID returns an interceptor that assigns an ID derived from the type,
+// group and payload of the item if it has none.
+func AssignID() Interceptor {
+	return func(_ context.Context, item Item) ([]Item, error) {
+		if item.ID == "" {
+			item.ID = generateID(fmt.Sprintf("%s_%s_%s", item.Type, item.GroupID, item.Payload))
+		}
+		return []Item{item}, nil
+	}
+}
+
+// intercept applies all interceptors to the item and returns the items to
+// be pushed in its place.
+func intercept(ctx context.Context, ics []Interceptor, item Item) ([]Item, error) {
+	items := []Item{item}
+	for _, ic := range ics {
+		var next []Item
+		for _, item := range items {
+			res, err := ic(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, res...)
+		}
+		items = next
+	}
+	return items, nil
+}
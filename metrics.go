@@ -0,0 +1,20 @@
+package genie
+
+import "expvar"
+
+// metrics exposes process-wide queue counters via expvar under 'genie'.
+// Router() serves these at /debug/vars.
+var metrics = expvar.NewMap("genie")
+
+// Metric keys published on the 'genie' expvar map.
+const (
+	metricProcessed = "processed" // handler invocations.
+	metricDone      = "done"      // invocations that moved item to DONE.
+	metricFailed    = "failed"    // invocations that moved item to FAILED.
+	metricSkipped   = "skipped"   // invocations that moved item to SKIPPED.
+	metricCancelled = "cancelled" // invocations that were cancelled while running.
+	metricWaiting   = "waiting"   // invocations that spawned children.
+	metricExpired   = "expired"   // items that moved to EXPIRED past their deadline.
+	metricRetried   = "retried"   // invocations that left item PENDING.
+	metricPanics    = "panics"    // invocations where the handler panicked.
+)
@@ -0,0 +1,251 @@
+package genie
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Handler to add cross-cutting behaviour around both
+// Handle and Sanitize.
+type Middleware func(next Handler) Handler
+
+// Chain composes the middlewares into a single Middleware. The first one
+// is the outermost, i.e., Chain(a, b)(h) is same as a(b(h)).
+func Chain(mws ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// HandlerFuncs implements Handler using a pair of funcs. Nil funcs are
+// treated as no-ops. Useful for writing middlewares.
+type HandlerFuncs struct {
+	HandleFn   func(ctx context.Context, item Item) ([]byte, error)
+	SanitizeFn func(ctx context.Context, item *Item) error
+}
+
+func (h HandlerFuncs) Handle(ctx context.Context, item Item) ([]byte, error) {
+	if h.HandleFn == nil {
+		return nil, nil
+	}
+	return h.HandleFn(ctx, item)
+}
+
+func (h HandlerFuncs) Sanitize(ctx context.Context, item *Item) error {
+	if h.SanitizeFn == nil {
+		return nil
+	}
+	return h.SanitizeFn(ctx, item)
+}
+
+// Recover converts panics in Handle and Sanitize into PanicError. The queue
+// always recovers handler panics, this is useful for recovering panics in
+// Sanitize or before other middlewares see them.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFuncs{
+			HandleFn: func(ctx context.Context, item Item) (_ []byte, err error) {
+				defer recoverPanic(&err)
+				return next.Handle(ctx, item)
+			},
+			SanitizeFn: func(ctx context.Context, item *Item) (err error) {
+				defer recoverPanic(&err)
+				return next.Sanitize(ctx, item)
+			},
+		}
+	}
+}
+
+// Logging logs every Handle invocation with its duration and outcome and
+// every Sanitize failure. Uses the standard logger if logger is nil.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFuncs{
+			HandleFn: func(ctx context.Context, item Item) ([]byte, error) {
+				start := time.Now()
+				res, err := next.Handle(ctx, item)
+				if err != nil {
+					logger.Printf("handle(type='%s', id='%s', attempt=%d) failed in %s: %v",
+						item.Type, item.ID, item.Attempt, time.Since(start), err)
+				} else {
+					logger.Printf("handle(type='%s', id='%s', attempt=%d) finished in %s",
+						item.Type, item.ID, item.Attempt, time.Since(start))
+				}
+				return res, err
+			},
+			SanitizeFn: func(ctx context.Context, item *Item) error {
+				err := next.Sanitize(ctx, item)
+				if err != nil {
+					logger.Printf("sanitize(type='%s', id='%s') failed: %v", item.Type, item.ID, err)
+				}
+				return err
+			},
+		}
+	}
+}
+
+// Timeout bounds the time Handle and Sanitize are allowed to run for. This
+// applies in addition to the FnTimeout configured on the queue.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFuncs{
+			HandleFn: func(ctx context.Context, item Item) ([]byte, error) {
+				ctx, cancel := context.WithTimeout(ctx, d)
+				defer cancel()
+				return next.Handle(ctx, item)
+			},
+			SanitizeFn: func(ctx context.Context, item *Item) error {
+				ctx, cancel := context.WithTimeout(ctx, d)
+				defer cancel()
+				return next.Sanitize(ctx, item)
+			},
+		}
+	}
+}
+
+// Metrics publishes per-type call counts, error counts and cumulative
+// duration (in milliseconds) of Handle and Sanitize under the expvar map
+// with given name. Name must be unique across the process.
+func Metrics(name string) Middleware {
+	m := expvar.NewMap(name)
+
+	record := func(op, typ string, start time.Time, err error) {
+		m.Add(typ+"."+op+".calls", 1)
+		m.Add(typ+"."+op+".duration_ms", time.Since(start).Milliseconds())
+		if err != nil {
+			m.Add(typ+"."+op+".errors", 1)
+		}
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFuncs{
+			HandleFn: func(ctx context.Context, item Item) ([]byte, error) {
+				start := time.Now()
+				res, err := next.Handle(ctx, item)
+				record("handle", item.Type, start, err)
+				return res, err
+			},
+			SanitizeFn: func(ctx context.Context, item *Item) error {
+				start := time.Now()
+				err := next.Sanitize(ctx, item)
+				record("sanitize", item.Type, start, err)
+				return err
+			},
+		}
+	}
+}
+
+// StartSpan starts a span with the name and attributes, and returns the
+// context carrying the span along with the func that ends it with the
+// outcome. Adapters for tracing libraries (e.g., OpenTelemetry) implement
+// it for use with Tracing().
+type StartSpan func(ctx context.Context, name string, attrs map[string]string) (context.Context, func(err error))
+
+// Tracing traces every Handle and Sanitize invocation as a span named
+// 'genie.handle' or 'genie.sanitize' started using start. Spans carry the
+// type, ID and group of the item, and the attempt for Handle.
+func Tracing(start StartSpan) Middleware {
+	attrs := func(item Item) map[string]string {
+		return map[string]string{"genie.type": item.Type, "genie.id": item.ID, "genie.group_id": item.GroupID}
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFuncs{
+			HandleFn: func(ctx context.Context, item Item) (_ []byte, err error) {
+				a := attrs(item)
+				a["genie.attempt"] = strconv.Itoa(item.Attempt)
+				ctx, end := start(ctx, "genie.handle", a)
+				defer func() { end(err) }()
+				return next.Handle(ctx, item)
+			},
+			SanitizeFn: func(ctx context.Context, item *Item) (err error) {
+				ctx, end := start(ctx, "genie.sanitize", attrs(*item))
+				defer func() { end(err) }()
+				return next.Sanitize(ctx, item)
+			},
+		}
+	}
+}
+
+// RateLimit allows at most burst Handle invocations at once and refills one
+// every interval. Invocations wait for a token until their context is done.
+// The limit is local to the process and an interval <= 0 disables it. Burst
+// defaults to 1. See RateLimitType() for limits shared by all the processes
+// of a queue. Sanitize is not limited.
+func RateLimit(interval time.Duration, burst int) Middleware {
+	if burst <= 0 {
+		burst = 1
+	}
+	tb := &tokenBucket{interval: interval, burst: burst, tokens: float64(burst), last: time.Now()}
+
+	return func(next Handler) Handler {
+		return HandlerFuncs{
+			HandleFn: func(ctx context.Context, item Item) ([]byte, error) {
+				if err := tb.Wait(ctx); err != nil {
+					return nil, err
+				}
+				return next.Handle(ctx, item)
+			},
+			SanitizeFn: next.Sanitize,
+		}
+	}
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	tokens   float64
+	last     time.Time
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (tb *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		wait := tb.take()
+		if wait == 0 {
+			return nil
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// take consumes a token and returns 0 if one is available. Otherwise returns
+// the time until the next token becomes available.
+func (tb *tokenBucket) take() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	if tb.interval > 0 {
+		tb.tokens += float64(now.Sub(tb.last)) / float64(tb.interval)
+	}
+	if tb.tokens > float64(tb.burst) {
+		tb.tokens = float64(tb.burst)
+	}
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) * float64(tb.interval))
+}
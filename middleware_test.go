@@ -0,0 +1,95 @@
+package genie
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFuncs{
+				HandleFn: func(ctx context.Context, item Item) ([]byte, error) {
+					calls = append(calls, name+".handle")
+					return next.Handle(ctx, item)
+				},
+				SanitizeFn: func(ctx context.Context, item *Item) error {
+					calls = append(calls, name+".sanitize")
+					return next.Sanitize(ctx, item)
+				},
+			}
+		}
+	}
+
+	h := Chain(mark("a"), mark("b"))(HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		calls = append(calls, "h.handle")
+		return []byte("ok"), nil
+	}))
+
+	res, err := h.Handle(context.Background(), Item{})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(res))
+	require.NoError(t, h.Sanitize(context.Background(), &Item{}))
+	assert.Equal(t, []string{"a.handle", "b.handle", "h.handle", "a.sanitize", "b.sanitize"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover()(HandlerFuncs{
+		HandleFn: func(ctx context.Context, item Item) ([]byte, error) {
+			panic("handle")
+		},
+		SanitizeFn: func(ctx context.Context, item *Item) error {
+			panic("sanitize")
+		},
+	})
+
+	var pe *PanicError
+	_, err := h.Handle(context.Background(), Item{})
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, "handle", pe.Value)
+
+	err = h.Sanitize(context.Background(), &Item{})
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, "sanitize", pe.Value)
+}
+
+func TestTracing(t *testing.T) {
+	type span struct {
+		name  string
+		attrs map[string]string
+		err   error
+	}
+	var spans []span
+	start := func(ctx context.Context, name string, attrs map[string]string) (context.Context, func(err error)) {
+		return ctx, func(err error) { spans = append(spans, span{name: name, attrs: attrs, err: err}) }
+	}
+
+	h := Tracing(start)(HandlerFuncs{
+		HandleFn: func(ctx context.Context, item Item) ([]byte, error) { return nil, ErrFail },
+	})
+	item := Item{ID: "1", Type: "test", GroupID: "g", Attempt: 2}
+	_, err := h.Handle(context.Background(), item)
+	assert.ErrorIs(t, err, ErrFail)
+	require.NoError(t, h.Sanitize(context.Background(), &item))
+
+	require.Len(t, spans, 2)
+	assert.Equal(t, "genie.handle", spans[0].name)
+	assert.Equal(t, map[string]string{"genie.type": "test", "genie.id": "1", "genie.group_id": "g", "genie.attempt": "2"}, spans[0].attrs)
+	assert.ErrorIs(t, spans[0].err, ErrFail)
+	assert.Equal(t, "genie.sanitize", spans[1].name)
+	assert.NoError(t, spans[1].err)
+}
+
+func TestRateLimit_defaultBurst(t *testing.T) {
+	h := RateLimit(time.Hour, 0)(HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := h.Handle(ctx, Item{})
+	assert.NoError(t, err)
+}
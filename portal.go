@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"context"
 	"crypto/sha1"
-	_ "embed"
+	"embed"
 	"encoding/hex"
 	"errors"
+	"expvar"
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"strings"
@@ -18,22 +20,53 @@ import (
 )
 
 var (
-	//go:embed index.html
-	indexHTML string
+	//go:embed *.html
+	templatesFS embed.FS
 
 	//go:embed favicon.png
 	favicon []byte
 
-	indexTpl = template.Must(template.New("index").Parse(indexHTML))
+	templates = template.Must(template.New("").Funcs(template.FuncMap{
+		"highlight": highlight,
+		"percent":   func(f float64) float64 { return math.Floor(100 * f) },
+	}).ParseFS(templatesFS, "*.html"))
 )
 
+// maxGraphNodes is the maximum number of items drawn in a dependency graph.
+const maxGraphNodes = 500
+
+// statusStyles are the mermaid styles for the nodes of each status.
+var statusStyles = map[string]string{
+	StatusPending:   "fill:#fff,stroke:#6c757d",
+	StatusBlocked:   "fill:#e2e3e5,stroke:#6c757d,stroke-dasharray:4",
+	StatusRunning:   "fill:#fff3cd,stroke:#ffc107",
+	StatusWaiting:   "fill:#fff3cd,stroke:#6c757d,stroke-dasharray:4",
+	StatusDone:      "fill:#d1e7dd,stroke:#198754",
+	StatusFailed:    "fill:#f8d7da,stroke:#dc3545",
+	StatusSkipped:   "fill:#cff4fc,stroke:#0dcaf0",
+	StatusCancelled: "fill:#e2e3e5,stroke:#6c757d",
+	StatusExpired:   "fill:#e2e3e5,stroke:#343a40",
+}
+
+// statuses lists all item statuses for use in filters.
+var statuses = []string{StatusPending, StatusBlocked, StatusRunning, StatusWaiting, StatusDone, StatusFailed, StatusSkipped, StatusCancelled, StatusExpired}
+
 // Router returns a new web portal handler.
 func Router(q Queue, customBanner ...string) http.Handler {
 	r := mux.NewRouter()
 	r.Handle("/", handleIndexGet(q, strings.Join(customBanner, "\n"))).Methods(http.MethodGet)
 	r.Handle("/", handleUpload(q)).Methods(http.MethodPost)
 	r.Handle("/download", downloadJobs(q)).Methods(http.MethodGet)
+	r.Handle("/actions", handleAction(q)).Methods(http.MethodPost)
+	r.Handle("/pauses", handlePauseAction(q)).Methods(http.MethodPost)
+	r.Handle("/items", handleItemsGet(q)).Methods(http.MethodGet)
+	r.Handle("/items/{id}", handleItemGet(q)).Methods(http.MethodGet)
+	r.Handle("/search", handleSearchGet(q)).Methods(http.MethodGet)
+	r.Handle("/graph", handleGraphGet(q)).Methods(http.MethodGet)
+	r.Handle("/schedules", handleSchedulesGet(q)).Methods(http.MethodGet)
+	r.Handle("/schedules", handleScheduleAction(q)).Methods(http.MethodPost)
 	r.Handle("/favicon.png", handleFaviconGet())
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
 	return r
 }
 
@@ -55,15 +88,214 @@ func handleIndexGet(q Queue, banner string) http.HandlerFunc {
 		}
 		d["job_types"] = q.JobTypes()
 
+		pauses, err := q.Pauses(req.Context())
+		if err != nil {
+			d["error"] = fmt.Sprintf("pauses unavailable: %v", err)
+		}
+		d["pauses"] = pauses
+		d["paused"] = pausedKeys(pauses)
+
+		if breakers, err := q.Breakers(req.Context()); err != nil {
+			d["error"] = fmt.Sprintf("circuit breakers unavailable: %v", err)
+		} else {
+			d["breakers"] = breakers
+		}
+
 		if status := strings.TrimSpace(req.URL.Query().Get("status")); status != "" {
 			d["status"] = status
 		} else if errStr := strings.TrimSpace(req.URL.Query().Get("error")); errStr != "" {
 			d["error"] = errStr
 		}
 
-		if err := indexTpl.Execute(wr, d); err != nil {
-			log.Printf("failed to serve index page: %v", err)
+		renderPage(wr, "index.html", d)
+	}
+}
+
+func handleItemsGet(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		query := Query{
+			Filter: Filter{
+				GroupID: strings.TrimSpace(params.Get("group_id")),
+				Type:    strings.TrimSpace(params.Get("type")),
+				Status:  strings.ToUpper(strings.TrimSpace(params.Get("status"))),
+			},
+			IDPrefix:      strings.TrimSpace(params.Get("id_prefix")),
+			ErrorContains: strings.TrimSpace(params.Get("error_contains")),
+			SortBy:        params.Get("sort_by"),
+			Desc:          params.Get("desc") != "",
+			Cursor:        params.Get("cursor"),
+		}
+
+		d := map[string]interface{}{
+			"query":     query,
+			"job_types": q.JobTypes(),
+			"statuses":  statuses,
+		}
+
+		page, err := q.List(req.Context(), query)
+		if err != nil {
+			d["error"] = err.Error()
+		} else {
+			d["items"] = page.Items
+			if page.NextCursor != "" {
+				params.Set("cursor", page.NextCursor)
+				d["next"] = "/items?" + params.Encode()
+			}
 		}
+
+		renderPage(wr, "items.html", d)
+	}
+}
+
+func handleItemGet(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		d := map[string]interface{}{}
+
+		item, err := q.Get(req.Context(), mux.Vars(req)["id"])
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				wr.WriteHeader(http.StatusNotFound)
+			}
+			d["error"] = err.Error()
+		} else {
+			d["item"] = item
+			if attempts, err := q.Attempts(req.Context(), item.ID); err != nil {
+				d["error"] = fmt.Sprintf("attempts unavailable: %v", err)
+			} else {
+				d["attempts"] = attempts
+			}
+		}
+
+		renderPage(wr, "item.html", d)
+	}
+}
+
+func handleGraphGet(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		groupID := strings.TrimSpace(req.URL.Query().Get("group_id"))
+		d := map[string]interface{}{"group_id": groupID}
+
+		var items []Item
+		query := Query{Filter: Filter{GroupID: groupID}, SortBy: SortID, Limit: maxGraphNodes}
+		for len(items) < maxGraphNodes {
+			page, err := q.List(req.Context(), query)
+			if err != nil {
+				d["error"] = err.Error()
+				break
+			}
+			items = append(items, page.Items...)
+			if query.Cursor = page.NextCursor; query.Cursor == "" {
+				break
+			}
+		}
+		d["truncated"] = len(items) >= maxGraphNodes
+
+		deps, err := q.Dependencies(req.Context(), groupID)
+		if err != nil {
+			d["error"] = err.Error()
+		}
+		d["deps"] = deps
+		d["graph"] = dependencyGraph(items, deps)
+
+		renderPage(wr, "graph.html", d)
+	}
+}
+
+func handleSchedulesGet(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		d := map[string]interface{}{
+			"job_types":   q.JobTypes(),
+			"missed_runs": []MissedRunPolicy{MissedRunSkip, MissedRunCatchUp},
+		}
+
+		schedules, err := q.Schedules(req.Context())
+		if err != nil {
+			d["error"] = err.Error()
+		}
+		d["schedules"] = schedules
+
+		if status := strings.TrimSpace(req.URL.Query().Get("status")); status != "" {
+			d["status"] = status
+		} else if errStr := strings.TrimSpace(req.URL.Query().Get("error")); errStr != "" {
+			d["error"] = errStr
+		}
+
+		renderPage(wr, "schedules.html", d)
+	}
+}
+
+func handleScheduleAction(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		id := strings.TrimSpace(req.FormValue("id"))
+
+		var err error
+		action := req.FormValue("action")
+		switch action {
+		case "save":
+			_, err = q.PutSchedule(req.Context(), Schedule{
+				ID:         id,
+				Cron:       req.FormValue("cron"),
+				Timezone:   strings.TrimSpace(req.FormValue("timezone")),
+				Type:       req.FormValue("type"),
+				Payload:    req.FormValue("payload"),
+				GroupID:    req.FormValue("group_id"),
+				MissedRuns: MissedRunPolicy(req.FormValue("missed_runs")),
+			})
+
+		case "enable", "disable":
+			err = setScheduleDisabled(req.Context(), q, id, action == "disable")
+
+		case "delete":
+			err = q.DeleteSchedule(req.Context(), id)
+
+		default:
+			err = fmt.Errorf("unknown action '%s'", action)
+		}
+
+		if err != nil {
+			msg := fmt.Sprintf("%s '%s' failed: %v", action, id, err)
+			http.Redirect(wr, req, "/schedules?error="+url.QueryEscape(msg), http.StatusFound)
+			return
+		}
+		msg := fmt.Sprintf("%s applied to '%s'", action, id)
+		http.Redirect(wr, req, "/schedules?status="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
+
+func setScheduleDisabled(ctx context.Context, q Queue, id string, disabled bool) error {
+	schedules, err := q.Schedules(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range schedules {
+		if s.ID == id {
+			s.Disabled = disabled
+			_, err := q.PutSchedule(ctx, s)
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+func handleSearchGet(q Queue) http.HandlerFunc {
+	const maxHits = 50
+
+	return func(wr http.ResponseWriter, req *http.Request) {
+		text := strings.TrimSpace(req.URL.Query().Get("q"))
+		d := map[string]interface{}{"search": text}
+
+		if text != "" {
+			hits, err := q.Search(req.Context(), text, maxHits)
+			if err != nil {
+				d["error"] = err.Error()
+			} else {
+				d["hits"] = hits
+			}
+		}
+
+		renderPage(wr, "search.html", d)
 	}
 }
 
@@ -96,13 +328,52 @@ func handleUpload(q Queue) http.HandlerFunc {
 			})
 		}
 
-		if err := q.Push(req.Context(), items...); err != nil {
+		opts := PushOptions{
+			BestEffort: req.FormValue("bestEffort") != "",
+			OnConflict: ConflictMode(req.FormValue("onConflict")),
+		}
+		results, err := q.Push(req.Context(), opts, items...)
+		if err != nil && !errors.Is(err, ErrRejected) {
 			redirectErr(wr, req, fmt.Sprintf("failed to stream-read upload (error: %v)", err))
 			return
 		}
 
-		redirectMsg(wr, req, fmt.Sprintf("%d items queued successfully", len(items)))
+		accepted, ignored, rejections := summarisePush(results)
+		if errors.Is(err, ErrRejected) {
+			redirectErr(wr, req, fmt.Sprintf("nothing queued since some lines were rejected: %s", rejections))
+		} else if rejections != "" {
+			redirectErr(wr, req, fmt.Sprintf("%d items queued, %d ignored, rejected: %s", accepted, ignored, rejections))
+		} else {
+			redirectMsg(wr, req, fmt.Sprintf("%d items queued successfully, %d ignored", accepted, ignored))
+		}
+	}
+}
+
+// summarisePush returns the number of accepted and ignored items and a
+// description of the first few rejected lines.
+func summarisePush(results []PushResult) (int, int, string) {
+	const maxListed = 10
+
+	accepted, ignored := 0, 0
+	var rejections []string
+	for _, res := range results {
+		switch res.Status {
+		case PushAccepted, PushReplaced, PushCoalesced:
+			accepted++
+
+		case PushIgnored:
+			ignored++
+
+		case PushDuplicate, PushInvalid:
+			if len(rejections) == maxListed {
+				rejections = append(rejections, "...")
+			} else if len(rejections) < maxListed {
+				rejections = append(rejections, fmt.Sprintf("line %d (%s: %s)",
+					res.Index+1, strings.ToLower(res.Status), res.Reason))
+			}
+		}
 	}
+	return accepted, ignored, strings.Join(rejections, ", ")
 }
 
 func downloadJobs(q Queue) http.Handler {
@@ -126,6 +397,113 @@ func downloadJobs(q Queue) http.Handler {
 	})
 }
 
+func handleAction(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		if id := strings.TrimSpace(req.FormValue("id")); id != "" {
+			handleItemAction(wr, req, q, id)
+			return
+		}
+
+		f := Filter{
+			GroupID: strings.TrimSpace(req.FormValue("group_id")),
+			Type:    strings.TrimSpace(req.FormValue("type")),
+			Status:  strings.ToUpper(strings.TrimSpace(req.FormValue("status"))),
+		}
+
+		var n int
+		var err error
+		action := req.FormValue("action")
+		switch action {
+		case "cancel":
+			n, err = q.CancelAll(req.Context(), f)
+		case "retry":
+			n, err = q.RetryAll(req.Context(), f)
+		case "delete":
+			n, err = q.DeleteAll(req.Context(), f)
+		default:
+			err = fmt.Errorf("unknown action '%s'", action)
+		}
+
+		if err != nil {
+			redirectErr(wr, req, fmt.Sprintf("%s failed: %v", action, err))
+			return
+		}
+		redirectMsg(wr, req, fmt.Sprintf("%s applied to %d items", action, n))
+	}
+}
+
+func handlePauseAction(q Queue) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		p := Pause{
+			Type:    req.FormValue("type"),
+			GroupID: req.FormValue("group_id"),
+			Reason:  strings.TrimSpace(req.FormValue("reason")),
+		}
+
+		var err error
+		action := req.FormValue("action")
+		switch action {
+		case "pause":
+			err = q.Pause(req.Context(), p)
+		case "resume":
+			err = q.Resume(req.Context(), p)
+		default:
+			err = fmt.Errorf("unknown action '%s'", action)
+		}
+
+		target := "type '" + p.Type + "'"
+		if p.GroupID != "" {
+			target = "group '" + p.GroupID + "'"
+		}
+		if err != nil {
+			redirectErr(wr, req, fmt.Sprintf("%s %s failed: %v", action, target, err))
+			return
+		}
+		redirectMsg(wr, req, fmt.Sprintf("%s applied to %s", action, target))
+	}
+}
+
+// pausedKeys returns the set of paused types and groups as 'type:<type>'
+// and 'group:<group-id>' keys for use in templates.
+func pausedKeys(pauses []Pause) map[string]bool {
+	keys := map[string]bool{}
+	for _, p := range pauses {
+		if p.Type != "" {
+			keys["type:"+p.Type] = true
+		} else {
+			keys["group:"+p.GroupID] = true
+		}
+	}
+	return keys
+}
+
+func handleItemAction(wr http.ResponseWriter, req *http.Request, q Queue, id string) {
+	var err error
+	action := req.FormValue("action")
+	switch action {
+	case "cancel":
+		err = q.Cancel(req.Context(), id)
+	case "retry":
+		err = q.Retry(req.Context(), id, nil)
+	case "delete":
+		err = q.Delete(req.Context(), id)
+	default:
+		err = fmt.Errorf("unknown action '%s'", action)
+	}
+
+	if err != nil {
+		redirectErr(wr, req, fmt.Sprintf("%s '%s' failed: %v", action, id, err))
+		return
+	}
+	redirectMsg(wr, req, fmt.Sprintf("%s applied to '%s'", action, id))
+}
+
+func renderPage(wr http.ResponseWriter, name string, data map[string]interface{}) {
+	if err := templates.ExecuteTemplate(wr, name, data); err != nil {
+		log.Printf("failed to serve page '%s': %v", name, err)
+	}
+}
+
 func redirectErr(wr http.ResponseWriter, req *http.Request, msg string) {
 	http.Redirect(wr, req, "/?error="+url.QueryEscape(msg), http.StatusFound)
 }
@@ -134,6 +512,62 @@ func redirectMsg(wr http.ResponseWriter, req *http.Request, msg string) {
 	http.Redirect(wr, req, "/?status="+url.QueryEscape(msg), http.StatusFound)
 }
 
+// highlight escapes the search snippet and marks the matched terms that
+// are enclosed in the snippet delimiters.
+func highlight(snippet string) template.HTML {
+	parts := strings.Split(snippet, snippetStart)
+	var sb strings.Builder
+	sb.WriteString(template.HTMLEscapeString(parts[0]))
+	for _, part := range parts[1:] {
+		match, rest := part, ""
+		if i := strings.Index(part, snippetEnd); i >= 0 {
+			match, rest = part[:i], part[i+len(snippetEnd):]
+		}
+		sb.WriteString("<mark>" + template.HTMLEscapeString(match) + "</mark>")
+		sb.WriteString(template.HTMLEscapeString(rest))
+	}
+	return template.HTML(sb.String())
+}
+
+// dependencyGraph returns the mermaid flowchart of the items and their
+// dependencies. Parents outside the given items are drawn as plain nodes.
+func dependencyGraph(items []Item, deps []Dependency) string {
+	var sb strings.Builder
+	sb.WriteString("graph LR\n")
+	for _, status := range statuses {
+		fmt.Fprintf(&sb, "    classDef %s %s\n", status, statusStyles[status])
+	}
+
+	nodes := map[string]string{}
+	addNode := func(id, status string) string {
+		if name, ok := nodes[id]; ok {
+			return name
+		}
+		name := fmt.Sprintf("n%d", len(nodes))
+		nodes[id] = name
+
+		label := strings.ReplaceAll(id, `"`, "#quot;")
+		if status != "" {
+			fmt.Fprintf(&sb, "    %s[\"%s (%s)\"]:::%s\n", name, label, status, status)
+		} else {
+			fmt.Fprintf(&sb, "    %s[\"%s\"]\n", name, label)
+		}
+		fmt.Fprintf(&sb, "    click %s \"/items/%s\"\n", name, url.PathEscape(id))
+		return name
+	}
+
+	for _, item := range items {
+		addNode(item.ID, item.Status)
+	}
+	for _, dep := range deps {
+		if _, ok := nodes[dep.ItemID]; !ok {
+			continue // dependent was not loaded.
+		}
+		fmt.Fprintf(&sb, "    %s --> %s\n", addNode(dep.ParentID, ""), nodes[dep.ItemID])
+	}
+	return sb.String()
+}
+
 func generateID(s string) string {
 	h := sha1.New()
 	h.Write([]byte(s))
@@ -145,22 +579,30 @@ func doPercent(stats []Stats) []percentStat {
 	result := make([]percentStat, len(stats), len(stats))
 	for i, stat := range stats {
 		result[i] = percentStat{
-			GroupID: stat.GroupID,
-			Type:    stat.Type,
-			Total:   stat.Total,
-			Done:    float64(100 * stat.Done / stat.Total),
-			Failed:  float64(100 * stat.Failed / stat.Total),
-			Skipped: float64(100 * stat.Skipped / stat.Total),
+			GroupID:   stat.GroupID,
+			Type:      stat.Type,
+			Total:     stat.Total,
+			Done:      float64(100 * stat.Done / stat.Total),
+			Failed:    float64(100 * stat.Failed / stat.Total),
+			Skipped:   float64(100 * stat.Skipped / stat.Total),
+			Cancelled: float64(100 * stat.Cancelled / stat.Total),
+			Expired:   float64(100 * stat.Expired / stat.Total),
+			Running:   float64(100 * stat.Running / stat.Total),
+			Progress:  math.Floor(100 * stat.Progress),
 		}
 	}
 	return result
 }
 
 type percentStat struct {
-	GroupID string  `json:"group_id"`
-	Type    string  `json:"type"`
-	Total   int     `json:"total"`
-	Done    float64 `json:"done"`
-	Failed  float64 `json:"failed"`
-	Skipped float64 `json:"skipped"`
+	GroupID   string  `json:"group_id"`
+	Type      string  `json:"type"`
+	Total     int     `json:"total"`
+	Done      float64 `json:"done"`
+	Failed    float64 `json:"failed"`
+	Skipped   float64 `json:"skipped"`
+	Cancelled float64 `json:"cancelled"`
+	Expired   float64 `json:"expired"`
+	Running   float64 `json:"running"`
+	Progress  float64 `json:"progress"`
 }
@@ -0,0 +1,122 @@
+package genie
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Outcomes of pushing an individual item.
+const (
+	PushAccepted  = "ACCEPTED"  // item was stored on the queue.
+	PushReplaced  = "REPLACED"  // item replaced an existing item with same ID.
+	PushIgnored   = "IGNORED"   // item was dropped as an allowed duplicate.
+	PushDuplicate = "DUPLICATE" // an item with same ID already exists.
+	PushInvalid   = "INVALID"   // an interceptor or Sanitize rejected the item.
+	PushAborted   = "ABORTED"   // item is valid but the push was rolled back.
+	PushCoalesced = "COALESCED" // item was merged into a pending item with same coalesce key.
+)
+
+// ConflictMode decides what Push does with an item whose ID already exists.
+type ConflictMode string
+
+// Conflict modes supported by Push.
+const (
+	ConflictReject          ConflictMode = ""                 // reject as duplicate.
+	ConflictIgnore          ConflictMode = "ignore"           // keep the existing item.
+	ConflictReplaceTerminal ConflictMode = "replace_terminal" // replace if existing is terminal.
+	ConflictReplace         ConflictMode = "replace"          // replace existing item unless in flight.
+)
+
+// ErrRejected is returned by Push when some items were rejected and hence
+// nothing was stored since the push was not in best-effort mode.
+var ErrRejected = errors.New("one or more items rejected")
+
+// PushOptions control how a single Push call is applied.
+type PushOptions struct {
+	// BestEffort stores all acceptable items even if some are rejected.
+	// By default, a push is all-or-nothing.
+	BestEffort bool
+
+	// OnConflict decides what happens to items whose ID already exists on
+	// the queue. Replaced items start afresh as pending. Items that are
+	// RUNNING, WAITING or BLOCKED are never replaced and are reported as
+	// duplicates.
+	OnConflict ConflictMode
+
+	// DedupeWindow, when set, ignores items with the same type, group and
+	// payload as an item pushed within the window. Items with a CoalesceKey
+	// are checked before they are coalesced.
+	DedupeWindow time.Duration
+
+	// Debounce delays the start of items with a CoalesceKey by the window
+	// from the time of push. Since each push coalesced into a pending item
+	// pushes its start back, the item runs once pushes stop for the window.
+	Debounce time.Duration
+}
+
+// PushResult is the outcome of pushing a single item. Index is the position
+// of the source item in the Push call. Interceptors expanding an item into
+// many produce multiple results with the same index.
+type PushResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// pushCandidate is a valid item to be stored and the index of its result.
+type pushCandidate struct {
+	Item
+	result int
+}
+
+// preparePush applies interceptors and sanitization to the items. Returns a
+// result for every item with rejected items marked INVALID and the rest
+// marked ACCEPTED, along with the candidates to be stored.
+func preparePush(ctx context.Context, ics []Interceptor, h Handler, items []Item) ([]PushResult, []pushCandidate) {
+	var results []PushResult
+	var candidates []pushCandidate
+
+	for i, src := range items {
+		expanded, err := intercept(ctx, ics, src)
+		if err != nil {
+			results = append(results, PushResult{Index: i, ID: src.ID, Status: PushInvalid, Reason: err.Error()})
+			continue
+		}
+
+		for _, item := range expanded {
+			if err := h.Sanitize(ctx, &item); err != nil {
+				results = append(results, PushResult{Index: i, ID: item.ID, Status: PushInvalid, Reason: err.Error()})
+				continue
+			}
+
+			candidates = append(candidates, pushCandidate{Item: item, result: len(results)})
+			results = append(results, PushResult{Index: i, ID: item.ID, Status: PushAccepted})
+		}
+	}
+
+	return results, candidates
+}
+
+// rejected returns true if any of the results is a rejection.
+func rejected(results []PushResult) bool {
+	for _, res := range results {
+		if res.Status == PushDuplicate || res.Status == PushInvalid {
+			return true
+		}
+	}
+	return false
+}
+
+// contentHash returns the hash used to detect duplicate submissions.
+func contentHash(item Item) string {
+	h := sha1.New()
+	for _, s := range []string{item.Type, item.GroupID, item.Payload} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
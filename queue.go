@@ -3,17 +3,29 @@ package genie
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
 	"time"
 )
 
 // Status values an item on the queue can have.
 const (
-	StatusDone    = "DONE"    // fn finished successfully.
-	StatusFailed  = "FAILED"  // all attempts failed or fn returned ErrFail.
-	StatusPending = "PENDING" // attempts are still remaining.
-	StatusSkipped = "SKIPPED" // fn returned ErrSkip
+	StatusDone      = "DONE"      // fn finished successfully.
+	StatusFailed    = "FAILED"    // all attempts failed or fn returned ErrFail.
+	StatusPending   = "PENDING"   // attempts are still remaining.
+	StatusRunning   = "RUNNING"   // claimed by a worker and being executed.
+	StatusBlocked   = "BLOCKED"   // waiting for the items it depends on.
+	StatusWaiting   = "WAITING"   // waiting for the children it spawned.
+	StatusSkipped   = "SKIPPED"   // fn returned ErrSkip
+	StatusCancelled = "CANCELLED" // cancelled by the operator.
+	StatusExpired   = "EXPIRED"   // deadline passed before it could finish.
 )
 
+// terminalStatuses are statuses from which an item is never picked up again.
+var terminalStatuses = []string{StatusDone, StatusFailed, StatusSkipped, StatusCancelled, StatusExpired}
+
 var (
 	// ErrSkip can be returned by HandlerFn to indicate that the queued item
 	// be skipped immediately.
@@ -22,16 +34,231 @@ var (
 	// ErrFail can be returned by HandlerFn to indicate no further retries
 	// should be attempted.
 	ErrFail = errors.New("failed")
+
+	// ErrNotFound is returned when the item being looked up does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidStatus is returned when an operation is not allowed for the
+	// current status of the item.
+	ErrInvalidStatus = errors.New("operation not allowed in current status")
+
+	// ErrSearchDisabled is returned by Search when the queue was opened
+	// without full-text search enabled.
+	ErrSearchDisabled = errors.New("full-text search is not enabled")
 )
 
+// PanicPolicy decides what happens to an item whose handler panicked.
+type PanicPolicy int
+
+// Panic policies supported by the queue.
+const (
+	PanicRetry PanicPolicy = iota // treat the panic as a retryable failure.
+	PanicFail                     // fail the item without further retries.
+)
+
+// DependencyPolicy decides what happens to the dependents of an item that
+// did not finish successfully.
+type DependencyPolicy int
+
+// Dependency policies supported by the queue.
+const (
+	DependencyFail DependencyPolicy = iota // fail the dependents.
+	DependencySkip                         // skip the dependents.
+)
+
+// PanicError is returned in place of the handler result when the handler
+// panics. It carries the panic value and the stack trace at the panic.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v\n\n%s", e.Value, e.Stack) }
+
 // Queue represents a priority or delay queue.
 type Queue interface {
 	ForEach(ctx context.Context, groupID, status string, fn Fn) error
-	Push(ctx context.Context, items ...Item) error
+	Push(ctx context.Context, opts PushOptions, items ...Item) ([]PushResult, error)
 	Run(ctx context.Context) error
 	Stats() ([]Stats, error)
 	JobTypes() []string
 	Close() error
+
+	// Get returns the item with given ID or ErrNotFound.
+	Get(ctx context.Context, id string) (*Item, error)
+
+	// Cancel moves an unfinished item to CANCELLED. Handlers of running
+	// items have their context cancelled once the worker notices on its
+	// next lease renewal. Unfinished children of items waiting for them
+	// are cancelled as well. CancelAll does the same for all unfinished
+	// items matching the filter and returns the count.
+	Cancel(ctx context.Context, id string) error
+	CancelAll(ctx context.Context, f Filter) (int, error)
+
+	// Retry re-queues a finished item with its attempts reset, replacing
+	// its payload if one is given. RetryAll does the same for all items
+	// matching the filter that did not finish successfully and returns the
+	// count. DONE items are included only if the filter has Status DONE.
+	Retry(ctx context.Context, id string, payload *string) error
+	RetryAll(ctx context.Context, f Filter) (int, error)
+
+	// Delete removes the item from the queue. DeleteAll does the same for
+	// all items matching the filter and returns the count.
+	Delete(ctx context.Context, id string) error
+	DeleteAll(ctx context.Context, f Filter) (int, error)
+
+	// List returns a page of items matching the query. Pass the NextCursor
+	// of the returned page in the query to fetch the next page.
+	List(ctx context.Context, q Query) (*Page, error)
+
+	// Search returns up to limit items whose payload, result or last error
+	// match all the terms in text, best matches first. Returns
+	// ErrSearchDisabled if full-text search is not enabled.
+	Search(ctx context.Context, text string, limit int) ([]SearchHit, error)
+
+	// Attempts returns the execution history of the item, oldest first.
+	Attempts(ctx context.Context, id string) ([]Attempt, error)
+
+	// Dependencies returns the dependencies declared by items in the group.
+	Dependencies(ctx context.Context, groupID string) ([]Dependency, error)
+
+	// PutSchedule creates the schedule or replaces the one with the same
+	// ID and returns it with the next run computed. Schedules are fired by
+	// Run() of any instance sharing the queue, and each run is enqueued
+	// exactly once.
+	PutSchedule(ctx context.Context, s Schedule) (*Schedule, error)
+
+	// Schedules returns all the schedules. DeleteSchedule removes one.
+	Schedules(ctx context.Context) ([]Schedule, error)
+	DeleteSchedule(ctx context.Context, id string) error
+
+	// Pause stops items of the type or the group from being picked up by
+	// any instance sharing the queue until resumed. Paused items remain
+	// PENDING, and items already running are not affected. Resume lifts the
+	// pause or returns ErrNotFound, and Pauses returns the current pauses.
+	Pause(ctx context.Context, p Pause) error
+	Resume(ctx context.Context, p Pause) error
+	Pauses(ctx context.Context) ([]Pause, error)
+
+	// Breakers returns the state of the circuit breakers configured with
+	// this instance. See CircuitBreaker().
+	Breakers(ctx context.Context) ([]BreakerState, error)
+}
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "CLOSED"    // items are executed as usual.
+	BreakerOpen     = "OPEN"      // items are held until the cooldown passes.
+	BreakerHalfOpen = "HALF_OPEN" // a single item is being executed as a probe.
+)
+
+// Breaker configures a circuit breaker for a type. The breaker opens when
+// the failure rate of attempts within the sliding Window reaches Threshold.
+// While open, items of the type are held PENDING without consuming their
+// attempts. Once Cooldown passes, the breaker half-opens and a single item
+// is executed as a probe: the breaker closes if it succeeds and opens again
+// otherwise. Attempts that were skipped or cancelled are not counted.
+type Breaker struct {
+	Window    time.Duration `json:"window"`
+	Threshold float64       `json:"threshold"` // failure rate in (0, 1], <= 0 disables.
+
+	// MinAttempts is the minimum number of attempts within the window
+	// before the breaker can open. Defaults to 1.
+	MinAttempts int `json:"min_attempts"`
+
+	// Cooldown is the time the breaker stays open before each probe.
+	// Defaults to Window.
+	Cooldown time.Duration `json:"cooldown"`
+}
+
+// BreakerState is the state of the circuit breaker of a type along with
+// the attempts within its current window.
+type BreakerState struct {
+	Type     string    `json:"type"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	ProbeAt  time.Time `json:"probe_at,omitempty"` // when an open breaker half-opens.
+}
+
+// Pause identifies the type or the group to be paused. Exactly one of Type
+// or GroupID must be set.
+type Pause struct {
+	Type     string    `json:"type,omitempty" db:"type"`
+	GroupID  string    `json:"group_id,omitempty" db:"group_id"`
+	Reason   string    `json:"reason,omitempty" db:"reason"`
+	PausedAt time.Time `json:"paused_at" db:"paused_at"`
+}
+
+// validate returns error if the pause is not for exactly one of type or group.
+func (p *Pause) validate() error {
+	p.Type = strings.TrimSpace(p.Type)
+	p.GroupID = strings.TrimSpace(p.GroupID)
+	if (p.Type == "") == (p.GroupID == "") {
+		return errors.New("exactly one of type or group id must be set")
+	}
+	return nil
+}
+
+// Dependency is an edge of the dependency graph. The item is blocked until
+// the parent is DONE.
+type Dependency struct {
+	ItemID   string `json:"item_id" db:"item_id"`
+	ParentID string `json:"parent_id" db:"parent_id"`
+}
+
+// Filter selects items for bulk operations. Empty fields match all items,
+// but at least one field must be set.
+type Filter struct {
+	GroupID string `json:"group_id"`
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+}
+
+// IsEmpty returns true if the filter matches all items.
+func (f Filter) IsEmpty() bool { return f == Filter{} }
+
+// Sort fields supported by List.
+const (
+	SortCreatedAt = "created_at"
+	SortUpdatedAt = "updated_at"
+	SortID        = "id"
+)
+
+// Query selects items for List. Zero values of fields match all items.
+type Query struct {
+	Filter
+
+	IDPrefix      string    `json:"id_prefix"`
+	ErrorContains string    `json:"error_contains"`
+	CreatedAfter  time.Time `json:"created_after"`
+	CreatedBefore time.Time `json:"created_before"`
+	UpdatedAfter  time.Time `json:"updated_after"`
+	UpdatedBefore time.Time `json:"updated_before"`
+
+	// SortBy is one of the Sort* fields. Defaults to SortCreatedAt.
+	SortBy string `json:"sort_by"`
+	Desc   bool   `json:"desc"`
+
+	// Limit is the maximum items in the page. Defaults to 100.
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+// SearchHit is an item matched by Search along with a snippet of the text
+// that matched. Matched terms in the snippet are enclosed in the STX and
+// ETX control characters ("\x02" and "\x03").
+type SearchHit struct {
+	Item
+	Snippet string `json:"snippet"`
+}
+
+// Page is a page of items returned by List. NextCursor is empty if there
+// are no more items.
+type Page struct {
+	Items      []Item `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // Options represents optional queue configurations.
@@ -40,6 +267,241 @@ type Options struct {
 	FnTimeout    time.Duration
 	MaxAttempts  int
 	RetryBackoff time.Duration
+
+	// DrainTimeout is the maximum time Run() waits for in-flight items to
+	// finish after its context is cancelled. Handlers still running after
+	// this will have their context cancelled.
+	DrainTimeout time.Duration
+
+	// PanicPolicy decides whether an item is retried or failed when its
+	// handler panics. Defaults to PanicRetry.
+	PanicPolicy PanicPolicy
+
+	// DependencyPolicy decides whether the dependents of an item that is
+	// FAILED, SKIPPED, CANCELLED, EXPIRED or deleted are failed or skipped.
+	// Defaults to DependencyFail.
+	DependencyPolicy DependencyPolicy
+
+	// Interceptors are applied in order to every item pushed to the queue
+	// before the Handler sanitizes it.
+	Interceptors []Interceptor
+
+	// FullTextSearch maintains a full-text index over payload, result and
+	// last error of items for Search. For the sqlite3 queue this requires
+	// building with '-tags sqlite_fts5'. Once enabled, the index is kept up
+	// to date by all processes sharing the database, which must be opened
+	// by such builds, until it is dropped with DropSearchIndex.
+	FullTextSearch bool
+
+	// DropSearchIndex stops maintaining the full-text index when the queue
+	// is opened, which disables Search for all processes sharing the
+	// database. The index is rebuilt when search is enabled again.
+	DropSearchIndex bool
+
+	// WorkerID identifies this process in the attempt history. Defaults to
+	// 'hostname:pid'.
+	WorkerID string
+
+	// MaxLogSize is the maximum bytes of Logger() output retained for each
+	// attempt. Output beyond this is discarded.
+	MaxLogSize int
+
+	// ProgressInterval is the minimum time between two progress updates
+	// persisted for an item. See ReportProgress().
+	ProgressInterval time.Duration
+
+	// TypeFinalizers and GroupFinalizers are invoked once for each group
+	// when all of its items are finished. See FinalizeType() and
+	// FinalizeGroup().
+	TypeFinalizers  map[string]Finalizer
+	GroupFinalizers map[string]Finalizer
+
+	// LeaseTimeout is the duration for which a worker holds a running item.
+	// The lease is renewed every LeaseTimeout/3 while the handler runs, and
+	// items whose lease expires (e.g., worker crashed) are picked up again
+	// with the lost attempt counted as failed. The handler context is
+	// cancelled if the item is cancelled while running. Must be at least
+	// 1ms.
+	LeaseTimeout time.Duration
+
+	// TypeRateLimits and GroupRateLimits limit how often items of a type
+	// or a group are started. See RateLimitType() and RateLimitGroup().
+	TypeRateLimits  map[string]Limit
+	GroupRateLimits map[string]Limit
+
+	// KeyConcurrency is the maximum number of items with the same
+	// ConcurrencyKey running at once. Must be at least 1, which is the
+	// default.
+	KeyConcurrency int
+
+	// Coalescers merge items pushed with a CoalesceKey into the pending
+	// item by type. See CoalesceType().
+	Coalescers map[string]Coalescer
+
+	// Breakers are the circuit breakers by type. See CircuitBreaker().
+	Breakers map[string]Breaker
+}
+
+// Limit is a token bucket that allows Burst items to be started at once
+// and refills one token every Interval. Buckets are stored in the backend
+// so the limit applies across all the processes sharing the queue, which
+// must all be configured with the same limits.
+type Limit struct {
+	Interval time.Duration `json:"interval"`
+	Burst    int           `json:"burst"`
+}
+
+// Option can be provided to Open() to customise the queue configurations.
+type Option func(opts *Options)
+
+// DrainTimeout sets the time allowed for in-flight items to finish once
+// the queue is asked to shut down.
+func DrainTimeout(d time.Duration) Option {
+	return func(opts *Options) { opts.DrainTimeout = d }
+}
+
+// WorkerID sets the identity recorded in the attempt history for items
+// executed by this process.
+func WorkerID(id string) Option {
+	return func(opts *Options) { opts.WorkerID = id }
+}
+
+// OnDependencyFailure sets the policy applied to dependents of items that
+// do not finish successfully.
+func OnDependencyFailure(policy DependencyPolicy) Option {
+	return func(opts *Options) { opts.DependencyPolicy = policy }
+}
+
+// FinalizeType registers fn to be invoked once for every group that has
+// items of the type, after all the items of the group are finished.
+func FinalizeType(typ string, fn Finalizer) Option {
+	return func(opts *Options) {
+		if opts.TypeFinalizers == nil {
+			opts.TypeFinalizers = map[string]Finalizer{}
+		}
+		opts.TypeFinalizers[typ] = fn
+	}
+}
+
+// FinalizeGroup registers fn to be invoked once after all the items of the
+// group are finished.
+func FinalizeGroup(groupID string, fn Finalizer) Option {
+	return func(opts *Options) {
+		if opts.GroupFinalizers == nil {
+			opts.GroupFinalizers = map[string]Finalizer{}
+		}
+		opts.GroupFinalizers[groupID] = fn
+	}
+}
+
+// CoalesceType registers fn to merge items of the type pushed with a
+// CoalesceKey into the pending item with the same key. Without one, the
+// pushed item replaces the pending item.
+func CoalesceType(typ string, fn Coalescer) Option {
+	return func(opts *Options) {
+		if opts.Coalescers == nil {
+			opts.Coalescers = map[string]Coalescer{}
+		}
+		opts.Coalescers[typ] = fn
+	}
+}
+
+// CircuitBreaker configures a circuit breaker for items of the type. State
+// of the breaker is stored in the backend and shared by all the processes
+// sharing the queue, which must all be configured with the same breakers.
+func CircuitBreaker(typ string, b Breaker) Option {
+	return func(opts *Options) {
+		if opts.Breakers == nil {
+			opts.Breakers = map[string]Breaker{}
+		}
+		opts.Breakers[typ] = b
+	}
+}
+
+// KeyConcurrency sets the maximum number of items with the same
+// ConcurrencyKey running at once. Open() fails if n < 1.
+func KeyConcurrency(n int) Option {
+	return func(opts *Options) { opts.KeyConcurrency = n }
+}
+
+// RateLimitType allows at most burst items of the type to be started at
+// once and one more every interval, across all processes sharing the queue.
+// Items that would exceed the limit are left pending until a token is
+// available. An interval <= 0 disables the limit.
+func RateLimitType(typ string, interval time.Duration, burst int) Option {
+	return func(opts *Options) {
+		if opts.TypeRateLimits == nil {
+			opts.TypeRateLimits = map[string]Limit{}
+		}
+		opts.TypeRateLimits[typ] = Limit{Interval: interval, Burst: burst}
+	}
+}
+
+// RateLimitGroup is the same as RateLimitType but for items of the group.
+func RateLimitGroup(groupID string, interval time.Duration, burst int) Option {
+	return func(opts *Options) {
+		if opts.GroupRateLimits == nil {
+			opts.GroupRateLimits = map[string]Limit{}
+		}
+		opts.GroupRateLimits[groupID] = Limit{Interval: interval, Burst: burst}
+	}
+}
+
+// LeaseTimeout sets the lease duration for running items. See
+// Options.LeaseTimeout.
+func LeaseTimeout(d time.Duration) Option {
+	return func(opts *Options) { opts.LeaseTimeout = d }
+}
+
+// EnableSearch enables the full-text index required for Search.
+func EnableSearch() Option {
+	return func(opts *Options) { opts.FullTextSearch = true }
+}
+
+// DropSearch stops maintaining the full-text index. See
+// Options.DropSearchIndex.
+func DropSearch() Option {
+	return func(opts *Options) { opts.DropSearchIndex = true }
+}
+
+// OnPanic sets the policy applied to items whose handler panics.
+func OnPanic(policy PanicPolicy) Option {
+	return func(opts *Options) { opts.PanicPolicy = policy }
+}
+
+// minLeaseTimeout is the shortest lease that can be renewed reliably.
+const minLeaseTimeout = time.Millisecond
+
+// validate returns error if the options cannot be used by the queue.
+func (opts Options) validate() error {
+	if opts.LeaseTimeout < minLeaseTimeout {
+		return fmt.Errorf("lease timeout must be at least %s", minLeaseTimeout)
+	}
+	if opts.KeyConcurrency < 1 {
+		return errors.New("key concurrency must be at least 1")
+	}
+	if opts.FullTextSearch && opts.DropSearchIndex {
+		return errors.New("full-text search cannot be enabled and dropped at once")
+	}
+	return nil
+}
+
+func defaultOptions() Options {
+	hostname, _ := os.Hostname()
+
+	return Options{
+		WorkerID:     fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		PollInt:      1 * time.Second,
+		FnTimeout:    1 * time.Second,
+		MaxAttempts:  1,
+		RetryBackoff: 10 * time.Second,
+		DrainTimeout: 10 * time.Second,
+		MaxLogSize:   64 << 10,
+
+		ProgressInterval: 1 * time.Second,
+		LeaseTimeout:     30 * time.Second,
+		KeyConcurrency:   1,
+	}
 }
 
 // Handler is invoked by the queue instance when an item is available for
@@ -51,12 +513,42 @@ type Handler interface {
 
 type Fn func(ctx context.Context, item Item) error
 
+// Finalizer is invoked once all the items of a group are finished, with the
+// statistics of the group. Type in stats is empty if the group has items of
+// more than one type. Results of the items can be streamed using ForEach()
+// on q with stats.GroupID. Finalizers are invoked by Run() of the queue
+// instances they are registered with, and a finalizer is invoked only once
+// for a group even if it is registered with multiple instances. Groups that
+// finished before the finalizer was registered are finalized as well. ctx
+// is cancelled after Options.FnTimeout as for handlers.
+type Finalizer func(ctx context.Context, stats Stats, q Queue) error
+
+// Coalescer merges the item being pushed into the pending item with the same
+// CoalesceKey and returns the item to be stored in place of the pending
+// item. ID, Type and CoalesceKey of the returned item are ignored since
+// the pending item keeps them. Returning an error rejects the pushed item.
+type Coalescer func(ctx context.Context, pending, item Item) (Item, error)
+
 // HandlerFn implements Handler using Go native func value.
 type HandlerFn func(ctx context.Context, item Item) ([]byte, error)
 
 func (h HandlerFn) Handle(ctx context.Context, item Item) ([]byte, error) { return h(ctx, item) }
 func (h HandlerFn) Sanitize(_ context.Context, _ *Item) error             { return nil }
 
+// safeHandle invokes h for the item and converts any panic into PanicError.
+func safeHandle(ctx context.Context, h Handler, item Item) (res []byte, err error) {
+	defer recoverPanic(&err)
+	return h.Handle(ctx, item)
+}
+
+// recoverPanic must be deferred directly. It sets err to a PanicError if the
+// function panicked.
+func recoverPanic(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Value: v, Stack: debug.Stack()}
+	}
+}
+
 // Item represents an item on the queue.
 type Item struct {
 	ID          string    `json:"id"`
@@ -67,15 +559,92 @@ type Item struct {
 	MaxAttempts int       `json:"max_attempts"`
 	NextAttempt time.Time `json:"next_attempt"`
 	Result      string    `json:"result"`
+
+	// DependsOn lists IDs of items that must be DONE before this item is
+	// executed. Until then, the item is BLOCKED. Parents must be pushed
+	// before or along with the item; missing parents count as failed.
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// Deadline is the time after which the item is worthless. Items picked
+	// up or held (e.g., paused or blocked) past the deadline, or whose next
+	// retry would be past it, move to EXPIRED without the handler being
+	// invoked again. Zero value means no deadline.
+	Deadline time.Time `json:"deadline,omitempty"`
+
+	// ConcurrencyKey limits the items with the same key (e.g., a customer
+	// ID) running at once to Options.KeyConcurrency, across all workers and
+	// processes sharing the queue. Empty key means no limit.
+	ConcurrencyKey string `json:"concurrency_key,omitempty"`
+
+	// CoalesceKey merges the item into the PENDING item of the same type
+	// and key, if any, instead of adding a new one. Items spawned by a
+	// handler are only merged into items spawned by the same parent. The
+	// pending item keeps its ID and takes the payload, group, next attempt,
+	// deadline, max attempts and concurrency key of the item, or of the
+	// result of the Coalescer registered for the type. Items with a
+	// coalesce key cannot have dependencies.
+	CoalesceKey string `json:"coalesce_key,omitempty"`
+
+	// Metadata maintained by the queue. These are ignored by Push.
+	Status    string    `json:"status"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Progress  Progress  `json:"progress"`
+
+	// Checkpoint is the state last saved by the handler using Checkpoint().
+	// It is retained across attempts so that retries can resume from it.
+	Checkpoint []byte `json:"checkpoint,omitempty"`
+
+	// ParentID is the ID of the item that spawned this item, if any. See
+	// Spawn().
+	ParentID string `json:"parent_id,omitempty"`
+
+	// Children are the outcomes of items spawned by this item so far. The
+	// item is invoked again with these once all the children are finished.
+	Children []ChildOutcome `json:"children,omitempty"`
+}
+
+// ChildOutcome is the outcome of an item spawned by another item.
+type ChildOutcome struct {
+	ID        string `json:"id" db:"id"`
+	Type      string `json:"type" db:"type"`
+	Status    string `json:"status" db:"status"`
+	Result    string `json:"result,omitempty" db:"result"`
+	LastError string `json:"last_error,omitempty" db:"last_error"`
+}
+
+// Attempt is the record of a single execution of an item. Outcome is the
+// status the item moved to after the attempt.
+type Attempt struct {
+	ItemID     string        `json:"item_id"`
+	Number     int           `json:"attempt"`
+	WorkerID   string        `json:"worker_id"`
+	StartedAt  time.Time     `json:"started_at"`
+	EndedAt    time.Time     `json:"ended_at"`
+	Duration   time.Duration `json:"duration"`
+	Outcome    string        `json:"outcome"`
+	Error      string        `json:"error,omitempty"`
+	ResultSize int           `json:"result_size"`
+	Log        string        `json:"log,omitempty"`
 }
 
 // Stats represents queue status break down by type.
 type Stats struct {
-	GroupID string `json:"group_id" db:"group_id"`
-	Type    string `json:"type"`
-	Total   int    `json:"total"`
-	Done    int    `json:"done"`
-	Pending int    `json:"pending"`
-	Failed  int    `json:"failed"`
-	Skipped int    `json:"skipped"`
+	GroupID   string `json:"group_id" db:"group_id"`
+	Type      string `json:"type"`
+	Total     int    `json:"total"`
+	Done      int    `json:"done"`
+	Pending   int    `json:"pending"`
+	Blocked   int    `json:"blocked"`
+	Waiting   int    `json:"waiting"`
+	Running   int    `json:"running"`
+	Failed    int    `json:"failed"`
+	Skipped   int    `json:"skipped"`
+	Cancelled int    `json:"cancelled"`
+	Expired   int    `json:"expired"`
+
+	// Progress is the fraction of work completed counting finished items
+	// and the progress reported by pending and running ones.
+	Progress float64 `json:"progress"`
 }
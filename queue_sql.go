@@ -5,22 +5,39 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3" // sqlite3 driver
-
 )
 
-func newSQLQueue(u *url.URL, types []string, h Handler) (*sqlQueue, error) {
+func newSQLQueue(u *url.URL, types []string, h Handler, opts ...Option) (*sqlQueue, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
 	db, err := sqlx.Connect("sqlite3", u.Host)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := db.Exec(schema); err != nil {
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if options.FullTextSearch {
+		err = setupSearch(db)
+	} else if options.DropSearchIndex {
+		err = teardownSearch(db)
+	}
+	if err != nil {
 		_ = db.Close()
 		return nil, err
 	}
@@ -30,12 +47,7 @@ func newSQLQueue(u *url.URL, types []string, h Handler) (*sqlQueue, error) {
 		file:   u.Host,
 		types:  types,
 		handle: h,
-		opts: Options{
-			PollInt:      1 * time.Second,
-			FnTimeout:    1 * time.Second,
-			MaxAttempts:  1,
-			RetryBackoff: 10 * time.Second,
-		},
+		opts:   options,
 	}, nil
 }
 
@@ -48,89 +60,284 @@ type sqlQueue struct {
 	opts   Options
 	types  []string
 	handle Handler
+
+	// sweptAt is when Run last looked for finished groups to finalize.
+	sweptAt time.Time
+}
+
+// Push enqueues all items into the queue with pending status. Items with an
+// existing ID are handled as per opts.OnConflict. Unless opts.BestEffort is
+// set, no item is stored if any item is rejected and ErrRejected is returned.
+func (q *sqlQueue) Push(ctx context.Context, opts PushOptions, items ...Item) ([]PushResult, error) {
+	t := time.Now().UTC()
+
+	results, candidates := preparePush(ctx, q.opts.Interceptors, q.handle, items)
+	if len(candidates) == 0 {
+		return abortPush(results, opts)
+	}
+
+	tx, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, c := range candidates {
+		res := &results[c.result]
+		res.Status, res.Reason, err = q.pushItem(ctx, tx, opts, c.Item, "", t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rejected(results) && !opts.BestEffort {
+		// candidates are inserted anyway to report duplicates along with
+		// the invalid items. tx is rolled back on return.
+		return abortPush(results, opts)
+	}
+
+	if err := q.resolve(ctx, tx, t); err != nil {
+		return nil, err
+	}
+	return results, tx.Commit()
 }
 
-// Push enqueues all items into the queue with pending status.
-func (q *sqlQueue) Push(ctx context.Context, items ...Item) error {
+// pushItem stores the item along with its dependencies within the tx and
+// returns the push status. parentID is set for children spawned by handlers.
+func (q *sqlQueue) pushItem(ctx context.Context, tx *sqlx.Tx, opts PushOptions, item Item, parentID string, t time.Time) (string, string, error) {
+	if status, reason, err := dedupe(ctx, tx, opts, contentHash(item), t); err != nil || status != "" {
+		return status, reason, err
+	}
+
+	if item.CoalesceKey != "" {
+		if len(item.DependsOn) > 0 {
+			return PushInvalid, "items with coalesce key cannot have dependencies", nil
+		}
+		if debounced := t.Add(opts.Debounce); debounced.After(item.NextAttempt) {
+			item.NextAttempt = debounced
+		}
+
+		if status, reason, err := q.coalesce(ctx, tx, item, parentID, t); err != nil || status != "" {
+			return status, reason, err
+		}
+	}
+
+	rec := sqlQueueItem{
+		ID:             item.ID,
+		Type:           item.Type,
+		Status:         StatusPending,
+		Payload:        item.Payload,
+		GroupID:        item.GroupID,
+		MaxAttempts:    q.maxAttempts(item),
+		CreatedAt:      t,
+		UpdatedAt:      t,
+		NextAttemptAt:  item.NextAttempt.UTC(),
+		ContentHash:    sql.NullString{Valid: true, String: contentHash(item)},
+		ParentID:       sql.NullString{Valid: parentID != "", String: parentID},
+		Deadline:       sql.NullTime{Valid: !item.Deadline.IsZero(), Time: item.Deadline.UTC()},
+		ConcurrencyKey: sql.NullString{Valid: item.ConcurrencyKey != "", String: item.ConcurrencyKey},
+		CoalesceKey:    sql.NullString{Valid: item.CoalesceKey != "", String: item.CoalesceKey},
+	}
+
+	if len(item.DependsOn) > 0 {
+		rec.Status = StatusBlocked
+		if via, err := findCycle(ctx, tx, item.ID, item.DependsOn); err != nil {
+			return "", "", err
+		} else if via != "" {
+			return PushInvalid, fmt.Sprintf("dependency on '%s' creates a cycle", via), nil
+		}
+	}
+
+	status, reason, err := q.pushOne(ctx, tx, opts, rec)
+	if err != nil {
+		return "", "", err
+	}
+
+	if status == PushAccepted || status == PushReplaced {
+		if err := setDependencies(ctx, tx, item.ID, item.DependsOn); err != nil {
+			return "", "", err
+		}
+	}
+	return status, reason, nil
+}
+
+// pushOne stores the record within the tx and returns the push status.
+func (q *sqlQueue) pushOne(ctx context.Context, tx *sqlx.Tx, opts PushOptions, rec sqlQueueItem) (string, string, error) {
 	const insertQuery = `
-		INSERT INTO queue (id, type, group_id, status, created_at, updated_at, payload, max_attempts, next_attempt_at)
-		VALUES (:id, :type, :group_id, :status, :created_at, :updated_at, :payload, :max_attempts, :next_attempt_at)`
+		INSERT INTO queue (id, type, group_id, status, created_at, updated_at, payload, max_attempts, next_attempt_at, content_hash, parent_id, deadline, concurrency_key, coalesce_key, search_rowid)
+		VALUES (:id, :type, :group_id, :status, :created_at, :updated_at, :payload, :max_attempts, :next_attempt_at, :content_hash, :parent_id, :deadline, :concurrency_key, :coalesce_key,
+		        (SELECT coalesce(max(search_rowid), 0) + 1 FROM queue))
+		ON CONFLICT (id) DO NOTHING`
+
+	const replaceQuery = `
+		UPDATE queue
+		SET type=:type, group_id=:group_id, status=:status, payload=:payload,
+		    max_attempts=:max_attempts, attempts=0, next_attempt_at=:next_attempt_at,
+		    result=NULL, last_error=NULL, content_hash=:content_hash,
+		    progress=0, progress_message='', checkpoint=NULL, parent_id=:parent_id,
+		    deadline=:deadline, concurrency_key=:concurrency_key, coalesce_key=:coalesce_key,
+		    created_at=:created_at, updated_at=:updated_at
+		WHERE id=:id`
 
-	t := time.Now().UTC()
+	if n, err := namedExec(ctx, tx, insertQuery, rec); err != nil {
+		return "", "", err
+	} else if n > 0 {
+		return PushAccepted, "", nil
+	}
 
-	qItems := make([]sqlQueueItem, len(items), len(items))
-	for i, item := range items {
-		if err := q.handle.Sanitize(ctx, &item); err != nil {
-			return err
+	switch opts.OnConflict {
+	case ConflictIgnore:
+		return PushIgnored, "item with same id exists", nil
+
+	case ConflictReplace, ConflictReplaceTerminal:
+		// items in flight are never replaced since a worker or other items
+		// depend on their current state.
+		query := replaceQuery + ` AND status IN ('PENDING', ` + sqlList(terminalStatuses) + `)`
+		reason := "item with same id exists and is in flight"
+		if opts.OnConflict == ConflictReplaceTerminal {
+			query = replaceQuery + ` AND status IN (` + sqlList(terminalStatuses) + `)`
+			reason = "item with same id exists and is not finished"
 		}
 
-		// choose the maximum of default max attempts or item limit.
-		maxAttempts := q.opts.MaxAttempts
-		if item.MaxAttempts > 0 && item.MaxAttempts < maxAttempts {
-			maxAttempts = item.MaxAttempts
+		if n, err := namedExec(ctx, tx, query, rec); err != nil {
+			return "", "", err
+		} else if n > 0 {
+			return PushReplaced, "", nil
 		}
-		if maxAttempts <= 0 {
-			maxAttempts = 1
+		return PushDuplicate, reason, nil
+
+	default:
+		return PushDuplicate, "item with same id exists", nil
+	}
+}
+
+// maxAttempts returns the attempts allowed for the item, which is the item
+// limit capped by the default max attempts.
+func (q *sqlQueue) maxAttempts(item Item) int {
+	maxAttempts := q.opts.MaxAttempts
+	if item.MaxAttempts > 0 && item.MaxAttempts < maxAttempts {
+		maxAttempts = item.MaxAttempts
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	return maxAttempts
+}
+
+// dedupe returns PushIgnored if an item with the same content hash was
+// pushed within the dedupe window, or empty status otherwise.
+func dedupe(ctx context.Context, tx *sqlx.Tx, opts PushOptions, hash string, t time.Time) (string, string, error) {
+	if opts.DedupeWindow <= 0 {
+		return "", "", nil
+	}
+
+	var dupID string
+	err := tx.GetContext(ctx, &dupID, `SELECT id FROM queue WHERE content_hash=? AND created_at >= ? LIMIT 1`,
+		hash, t.Add(-opts.DedupeWindow))
+	if err == nil {
+		return PushIgnored, fmt.Sprintf("same content as '%s' pushed within %s", dupID, opts.DedupeWindow), nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", "", err
+	}
+	return "", "", nil
+}
+
+// coalesce merges the item into the pending item of the same type, coalesce
+// key and parent within the tx. Returns empty status if there is no such
+// item, in which case the item must be stored as usual.
+func (q *sqlQueue) coalesce(ctx context.Context, tx *sqlx.Tx, item Item, parentID string, t time.Time) (string, string, error) {
+	const selectQuery = `SELECT * FROM queue
+		WHERE coalesce_key=? AND type=? AND coalesce(parent_id, '')=? AND status='PENDING'
+		ORDER BY created_at LIMIT 1`
+
+	const updateQuery = `UPDATE queue
+		SET payload=?, group_id=?, next_attempt_at=?, deadline=?, max_attempts=?, concurrency_key=?, content_hash=?,
+		    attempts=0, last_error=NULL, progress=0, progress_message='', checkpoint=NULL, updated_at=?
+		WHERE id=? AND status='PENDING'`
+
+	var pending sqlQueueItem
+	if err := tx.GetContext(ctx, &pending, selectQuery, item.CoalesceKey, item.Type, parentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", nil
 		}
+		return "", "", err
+	}
 
-		qItems[i] = sqlQueueItem{
-			ID:            item.ID,
-			Type:          item.Type,
-			Status:        StatusPending,
-			Payload:       item.Payload,
-			GroupID:       item.GroupID,
-			MaxAttempts:   maxAttempts,
-			CreatedAt:     t,
-			UpdatedAt:     t,
-			NextAttemptAt: item.NextAttempt.UTC(),
+	merged := item
+	if fn, ok := q.opts.Coalescers[item.Type]; ok {
+		var err error
+		if merged, err = safeCoalesce(ctx, fn, pending.Item(), item); err != nil {
+			return PushInvalid, err.Error(), nil
 		}
 	}
 
-	_, err := q.db.NamedExecContext(ctx, insertQuery, qItems)
-	return err
+	deadline := sql.NullTime{Valid: !merged.Deadline.IsZero(), Time: merged.Deadline.UTC()}
+	concurrencyKey := sql.NullString{Valid: merged.ConcurrencyKey != "", String: merged.ConcurrencyKey}
+	n, err := execCount(ctx, tx, updateQuery, merged.Payload, merged.GroupID, merged.NextAttempt.UTC(),
+		deadline, q.maxAttempts(merged), concurrencyKey, contentHash(merged), t, pending.ID)
+	if err != nil || n == 0 {
+		return "", "", err
+	}
+	return PushCoalesced, fmt.Sprintf("coalesced into '%s'", pending.ID), nil
 }
 
-// Run starts the worker loop that fetches next item from the queue and applies
-// the given func. Runs until context is cancelled. fn can return nil, ErrFail,
-// ErrSkipped to move to DONE, FAILED or SKIPPED terminal statuses directly. If
-// fn returns any other error, it will remain in PENDING state and will be retried
-// after sometime.
-func (q *sqlQueue) Run(ctx context.Context) error {
-	timer := time.NewTimer(0)
-	defer timer.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
+func safeCoalesce(ctx context.Context, fn Coalescer, pending, item Item) (merged Item, err error) {
+	defer recoverPanic(&err)
+	return fn(ctx, pending, item)
+}
 
-		case <-timer.C:
-			timer.Reset(q.opts.PollInt)
-
-			records, err := q.getBatch(ctx, q.types)
-			if err != nil {
-				log.Printf("failed to read next batch: %v", err)
-			} else if len(records) == 0 {
-				continue
-			}
-
-			for _, rec := range records {
-				if err := q.processRecord(ctx, rec, q.handle); err != nil {
-					log.Printf("failed to process '%s': %v", rec.ID, err)
-				}
-			}
+// abortPush marks accepted items aborted and returns ErrRejected if any item
+// was rejected, unless in best-effort mode.
+func abortPush(results []PushResult, opts PushOptions) ([]PushResult, error) {
+	if opts.BestEffort || !rejected(results) {
+		return results, nil
+	}
+
+	for i := range results {
+		switch results[i].Status {
+		case PushAccepted, PushReplaced, PushCoalesced:
+			results[i].Status = PushAborted
 		}
 	}
+	return results, ErrRejected
 }
 
-// Stats returns entire queue statistics broken down by type.
-func (q *sqlQueue) Stats() ([]Stats, error) {
-	const query = `SELECT type, group_id, 
-	       count(*)                                       AS total,
+// namedExec executes the named query and returns the number of rows affected.
+func namedExec(ctx context.Context, tx *sqlx.Tx, query string, arg interface{}) (int64, error) {
+	res, err := tx.NamedExecContext(ctx, query, arg)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sqlList returns the values as a quoted list for use in SQL 'IN' clauses.
+// Must only be used with constant values.
+func sqlList(vals []string) string {
+	quoted := make([]string, len(vals), len(vals))
+	for i, v := range vals {
+		quoted[i] = "'" + v + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// statsColumns are the aggregates selected for Stats.
+var statsColumns = `count(*)                                       AS total,
 	       count(case when status = 'DONE' then 1 end)    AS done,
 	       count(case when status = 'PENDING' then 1 end) AS pending,
+	       count(case when status = 'BLOCKED' then 1 end) AS blocked,
+	       count(case when status = 'WAITING' then 1 end) AS waiting,
 	       count(case when status = 'SKIPPED' then 1 end) AS skipped,
-	       count(case when status = 'FAILED' then 1 end)  AS failed
+	       count(case when status = 'FAILED' then 1 end)  AS failed,
+	       count(case when status = 'CANCELLED' then 1 end) AS cancelled,
+	       count(case when status = 'EXPIRED' then 1 end) AS expired,
+	       count(case when status = 'RUNNING' then 1 end) AS running,
+	       (count(case when status IN (` + sqlList(terminalStatuses) + `) then 1 end) +
+	        total(case when status IN ('PENDING', 'RUNNING') then progress end)) / count(*) AS progress`
+
+// Stats returns entire queue statistics broken down by type.
+func (q *sqlQueue) Stats() ([]Stats, error) {
+	query := `SELECT type, group_id, ` + statsColumns + `
 	FROM queue
 	GROUP BY type, group_id;`
 	var stats []Stats
@@ -168,66 +375,6 @@ func (q *sqlQueue) ForEach(ctx context.Context, groupID, status string, fn Fn) e
 
 func (q *sqlQueue) JobTypes() []string { return q.types }
 
-func (q *sqlQueue) getBatch(ctx context.Context, supported []string) ([]sqlQueueItem, error) {
-	const selectQuery = `SELECT * FROM queue
-		WHERE status='PENDING' AND  next_attempt_at <= ? AND type IN (?)
-		ORDER BY next_attempt_at
-		LIMIT 10;`
-
-	query, args, err := sqlx.In(selectQuery, time.Now().UTC(), supported)
-	if err != nil {
-		return nil, err
-	}
-
-	var records []sqlQueueItem
-	err = q.db.SelectContext(ctx, &records, query, args...)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return nil, err
-	}
-	return records, nil
-}
-
-func (q *sqlQueue) processRecord(ctx context.Context, rec sqlQueueItem, h Handler) error {
-	fnCtx, cancel := context.WithTimeout(ctx, q.opts.FnTimeout)
-	defer cancel()
-
-	result, fnErr := h.Handle(fnCtx, rec.Item())
-	rec.Attempts++
-
-	if fnErr == nil {
-		rec.Status = StatusDone
-		rec.Result = sql.NullString{
-			Valid:  true,
-			String: string(result),
-		}
-	} else {
-		if errors.Is(fnErr, ErrFail) || rec.Attempts >= rec.MaxAttempts {
-			rec.Status = StatusFailed
-		} else if errors.Is(fnErr, ErrSkip) {
-			rec.Status = StatusSkipped
-		} else {
-			rec.Status = StatusPending
-		}
-
-		rec.NextAttemptAt = time.Now().Add(q.opts.RetryBackoff).UTC()
-		rec.LastError = sql.NullString{
-			Valid:  true,
-			String: fnErr.Error(),
-		}
-	}
-
-	const updateQuery = `UPDATE queue
-		SET status=:status, 
-		    last_error=:last_error, 
-		    next_attempt_at=:next_attempt_at, 
-		    attempts=:attempts,
-		    updated_at=current_timestamp,
-		    result=:result
-		WHERE id=:id`
-	_, err := q.db.NamedExecContext(ctx, updateQuery, rec)
-	return err
-}
-
 func (q *sqlQueue) String() string { return fmt.Sprintf("sqlQueue<file='%s'>", q.file) }
 
 func (q *sqlQueue) Close() error { return q.db.Close() }
@@ -253,6 +400,165 @@ const schema = `
 	CREATE INDEX IF NOT EXISTS index_next_attempt_at ON queue (next_attempt_at);
 `
 
+// migrations are applied in order on top of the schema. The schema version
+// stored as 'user_version' is the number of migrations applied. Only append
+// to this list.
+var migrations = []string{
+	`ALTER TABLE queue ADD COLUMN content_hash TEXT;
+	CREATE INDEX IF NOT EXISTS index_content_hash ON queue (content_hash, created_at);`,
+
+	`DROP INDEX IF EXISTS index_group_id;
+	CREATE INDEX IF NOT EXISTS index_group_id ON queue (group_id COLLATE binary);
+	CREATE INDEX IF NOT EXISTS index_created_at ON queue (created_at, id);
+	CREATE INDEX IF NOT EXISTS index_updated_at ON queue (updated_at, id);`,
+
+	`CREATE TABLE IF NOT EXISTS attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		worker_id TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		ended_at TIMESTAMP NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		outcome TEXT NOT NULL,
+		error TEXT,
+		result_size INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS index_attempts_item_id ON attempts (item_id);
+	CREATE TRIGGER IF NOT EXISTS queue_attempts_delete AFTER DELETE ON queue BEGIN
+		DELETE FROM attempts WHERE item_id = old.id;
+	END;`,
+
+	`ALTER TABLE attempts ADD COLUMN log TEXT;`,
+
+	`ALTER TABLE queue ADD COLUMN progress REAL NOT NULL DEFAULT 0;
+	ALTER TABLE queue ADD COLUMN progress_message TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE queue ADD COLUMN lease_owner TEXT;
+	ALTER TABLE queue ADD COLUMN lease_expires_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS index_status ON queue (status, next_attempt_at);`,
+
+	`ALTER TABLE queue ADD COLUMN checkpoint BLOB;`,
+
+	`CREATE TABLE IF NOT EXISTS dependencies (
+		item_id TEXT NOT NULL,
+		parent_id TEXT NOT NULL,
+		PRIMARY KEY (item_id, parent_id)
+	);
+	CREATE INDEX IF NOT EXISTS index_dependencies_parent_id ON dependencies (parent_id);
+	CREATE TRIGGER IF NOT EXISTS queue_dependencies_delete AFTER DELETE ON queue BEGIN
+		DELETE FROM dependencies WHERE item_id = old.id;
+	END;`,
+
+	`ALTER TABLE queue ADD COLUMN parent_id TEXT;
+	CREATE INDEX IF NOT EXISTS index_parent_id ON queue (parent_id);`,
+
+	`CREATE TABLE IF NOT EXISTS finalizations (
+		group_id TEXT NOT NULL,
+		finalizer TEXT NOT NULL,
+		status TEXT NOT NULL,
+		worker_id TEXT,
+		lease_expires_at TIMESTAMP,
+		error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP,
+		PRIMARY KEY (group_id, finalizer)
+	);
+	CREATE INDEX IF NOT EXISTS index_finalizations_status ON finalizations (status, created_at);`,
+
+	`CREATE TABLE IF NOT EXISTS schedules (
+		id TEXT PRIMARY KEY,
+		cron TEXT NOT NULL,
+		timezone TEXT NOT NULL,
+		type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		group_id TEXT NOT NULL,
+		missed_runs TEXT NOT NULL,
+		disabled BOOLEAN NOT NULL DEFAULT 0,
+		next_run_at TIMESTAMP NOT NULL,
+		last_run_at TIMESTAMP,
+		last_error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS index_schedules_next_run_at ON schedules (next_run_at);`,
+
+	`ALTER TABLE queue ADD COLUMN deadline TIMESTAMP;`,
+
+	`CREATE TABLE IF NOT EXISTS rate_limits (
+		key TEXT PRIMARY KEY,
+		tokens REAL NOT NULL,
+		refilled_at REAL NOT NULL
+	);`,
+
+	`ALTER TABLE queue ADD COLUMN concurrency_key TEXT;
+	CREATE INDEX IF NOT EXISTS index_concurrency_key ON queue (concurrency_key, status);`,
+
+	`ALTER TABLE queue ADD COLUMN coalesce_key TEXT;
+	CREATE INDEX IF NOT EXISTS index_coalesce_key ON queue (coalesce_key, status);`,
+
+	`CREATE TABLE IF NOT EXISTS pauses (
+		type TEXT NOT NULL,
+		group_id TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		paused_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (type, group_id)
+	);`,
+
+	`CREATE TABLE IF NOT EXISTS breakers (
+		type TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		probe_owner TEXT,
+		opened_at TIMESTAMP,
+		closed_at TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS index_attempts_ended_at ON attempts (ended_at);`,
+
+	`DROP INDEX IF EXISTS index_group_id;
+	CREATE INDEX IF NOT EXISTS index_group_id_status ON queue (group_id COLLATE binary, status);`,
+
+	`CREATE INDEX IF NOT EXISTS index_deadline ON queue (deadline) WHERE deadline IS NOT NULL;`,
+
+	`ALTER TABLE queue ADD COLUMN search_rowid INTEGER;
+	UPDATE queue SET search_rowid = rowid;
+	CREATE UNIQUE INDEX IF NOT EXISTS index_search_rowid ON queue (search_rowid);`,
+}
+
+func migrate(db *sqlx.DB) error {
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.Get(&version, `PRAGMA user_version`); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // sqlQueueItem should always match the above schema.
 type sqlQueueItem struct {
 	// Item attributes.
@@ -265,22 +571,84 @@ type sqlQueueItem struct {
 	UpdatedAt   time.Time      `json:"updated_at" db:"updated_at"`
 	MaxAttempts int            `json:"max_attempts" db:"max_attempts"`
 	Result      sql.NullString `json:"result" db:"result"`
+	ContentHash sql.NullString `json:"content_hash" db:"content_hash"`
 
 	// Execution info.
-	Attempts      int            `json:"attempts" db:"attempts"`
-	LastError     sql.NullString `json:"last_error" db:"last_error"`
-	NextAttemptAt time.Time      `json:"next_attempt_at" db:"next_attempt_at"`
+	Attempts        int            `json:"attempts" db:"attempts"`
+	LastError       sql.NullString `json:"last_error" db:"last_error"`
+	NextAttemptAt   time.Time      `json:"next_attempt_at" db:"next_attempt_at"`
+	Progress        float64        `json:"progress" db:"progress"`
+	ProgressMessage string         `json:"progress_message" db:"progress_message"`
+	LeaseOwner      sql.NullString `json:"lease_owner" db:"lease_owner"`
+	LeaseExpiresAt  sql.NullTime   `json:"lease_expires_at" db:"lease_expires_at"`
+	Checkpoint      []byte         `json:"checkpoint" db:"checkpoint"`
+	ParentID        sql.NullString `json:"parent_id" db:"parent_id"`
+	Deadline        sql.NullTime   `json:"deadline" db:"deadline"`
+	ConcurrencyKey  sql.NullString `json:"concurrency_key" db:"concurrency_key"`
+	CoalesceKey     sql.NullString `json:"coalesce_key" db:"coalesce_key"`
+
+	// SearchRowID keys the item in the full-text index. Unlike the implicit
+	// rowid, it does not change when the database is vacuumed.
+	SearchRowID sql.NullInt64 `json:"search_rowid" db:"search_rowid"`
 }
 
 func (rec sqlQueueItem) Item() Item {
 	return Item{
-		ID:          rec.ID,
-		Type:        rec.Type,
-		Result:      rec.Result.String,
-		Payload:     rec.Payload,
-		GroupID:     rec.GroupID,
-		Attempt:     rec.Attempts,
-		MaxAttempts: rec.MaxAttempts,
-		NextAttempt: rec.NextAttemptAt.Local(),
+		ID:             rec.ID,
+		Type:           rec.Type,
+		Result:         rec.Result.String,
+		Payload:        rec.Payload,
+		GroupID:        rec.GroupID,
+		Attempt:        rec.Attempts,
+		MaxAttempts:    rec.MaxAttempts,
+		NextAttempt:    rec.NextAttemptAt.Local(),
+		Status:         rec.Status,
+		LastError:      rec.LastError.String,
+		CreatedAt:      rec.CreatedAt.Local(),
+		UpdatedAt:      rec.UpdatedAt.Local(),
+		Progress:       Progress{Fraction: rec.Progress, Message: rec.ProgressMessage},
+		Checkpoint:     rec.Checkpoint,
+		ParentID:       rec.ParentID.String,
+		Deadline:       localTime(rec.Deadline),
+		ConcurrencyKey: rec.ConcurrencyKey.String,
+		CoalesceKey:    rec.CoalesceKey.String,
+	}
+}
+
+// localTime returns the time in local timezone, or zero time if null.
+func localTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time.Local()
+}
+
+// sqlAttempt should always match the attempts table.
+type sqlAttempt struct {
+	ID         int64          `db:"id"`
+	ItemID     string         `db:"item_id"`
+	Number     int            `db:"attempt"`
+	WorkerID   string         `db:"worker_id"`
+	StartedAt  time.Time      `db:"started_at"`
+	EndedAt    time.Time      `db:"ended_at"`
+	DurationMS int64          `db:"duration_ms"`
+	Outcome    string         `db:"outcome"`
+	Error      sql.NullString `db:"error"`
+	ResultSize int            `db:"result_size"`
+	Log        sql.NullString `db:"log"`
+}
+
+func (att sqlAttempt) Attempt() Attempt {
+	return Attempt{
+		ItemID:     att.ItemID,
+		Number:     att.Number,
+		WorkerID:   att.WorkerID,
+		StartedAt:  att.StartedAt.Local(),
+		EndedAt:    att.EndedAt.Local(),
+		Duration:   time.Duration(att.DurationMS) * time.Millisecond,
+		Outcome:    att.Outcome,
+		Error:      att.Error.String,
+		ResultSize: att.ResultSize,
+		Log:        att.Log.String,
 	}
 }
@@ -0,0 +1,275 @@
+package genie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var errEmptyFilter = errors.New("filter must have at least one field set")
+
+// Get returns the item with given ID or ErrNotFound.
+func (q *sqlQueue) Get(ctx context.Context, id string) (*Item, error) {
+	var rec sqlQueueItem
+	if err := q.db.GetContext(ctx, &rec, `SELECT * FROM queue WHERE id=?`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	item := rec.Item()
+	parents, err := q.parentsOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	item.DependsOn = parents
+
+	children, err := q.childrenOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	item.Children = children
+	return &item, nil
+}
+
+// Attempts returns the execution history of the item, oldest first.
+func (q *sqlQueue) Attempts(ctx context.Context, id string) ([]Attempt, error) {
+	var records []sqlAttempt
+	if err := q.db.SelectContext(ctx, &records, `SELECT * FROM attempts WHERE item_id=? ORDER BY id`, id); err != nil {
+		return nil, err
+	}
+
+	attempts := make([]Attempt, len(records), len(records))
+	for i, rec := range records {
+		attempts[i] = rec.Attempt()
+	}
+	return attempts, nil
+}
+
+// Cancel moves the unfinished item to CANCELLED status.
+func (q *sqlQueue) Cancel(ctx context.Context, id string) error {
+	n, err := q.cancel(ctx, `id=?`, id)
+	return q.expectOne(ctx, id, n, err)
+}
+
+// CancelAll moves all unfinished items matching the filter to CANCELLED.
+func (q *sqlQueue) CancelAll(ctx context.Context, f Filter) (int, error) {
+	cond, args, err := filterClause(f)
+	if err != nil {
+		return 0, err
+	}
+	return q.cancel(ctx, cond, args...)
+}
+
+// Retry moves the finished item back to PENDING (or BLOCKED if it has
+// dependencies) with its attempts reset.
+// If payload is not nil, it replaces the payload of the item and discards
+// the checkpoint saved by previous attempts.
+func (q *sqlQueue) Retry(ctx context.Context, id string, payload *string) error {
+	n, err := q.withTx(ctx, time.Now().UTC(), func(tx *sqlx.Tx) (int, error) {
+		if payload != nil {
+			query := `UPDATE queue SET payload=?, checkpoint=NULL WHERE id=? AND status IN (` + sqlList(terminalStatuses) + `)`
+			if _, err := tx.ExecContext(ctx, query, *payload, id); err != nil {
+				return 0, err
+			}
+		}
+		return retryTx(ctx, tx, `id=?`, id)
+	})
+	return q.expectOne(ctx, id, n, err)
+}
+
+// RetryAll moves all unsuccessful items matching the filter back to
+// PENDING or BLOCKED with their attempts reset. DONE items are retried only
+// if the filter asks for them explicitly.
+func (q *sqlQueue) RetryAll(ctx context.Context, f Filter) (int, error) {
+	cond, args, err := filterClause(f)
+	if err != nil {
+		return 0, err
+	}
+	if f.Status == "" {
+		cond += ` AND status != 'DONE'`
+	}
+	return q.retry(ctx, cond, args...)
+}
+
+// Delete removes the item from the queue.
+func (q *sqlQueue) Delete(ctx context.Context, id string) error {
+	n, err := q.delete(ctx, `id=?`, id)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteAll removes all items matching the filter from the queue.
+func (q *sqlQueue) DeleteAll(ctx context.Context, f Filter) (int, error) {
+	cond, args, err := filterClause(f)
+	if err != nil {
+		return 0, err
+	}
+	return q.delete(ctx, cond, args...)
+}
+
+// cancel cancels the unfinished items matching the condition along with
+// the unfinished descendants of those that were waiting for children.
+func (q *sqlQueue) cancel(ctx context.Context, cond string, args ...interface{}) (int, error) {
+	const unfinished = `status IN ('PENDING', 'BLOCKED', 'RUNNING', 'WAITING')`
+
+	query := `UPDATE queue
+		SET status='CANCELLED', lease_owner=NULL, lease_expires_at=NULL, updated_at=?
+		WHERE ` + unfinished + ` AND `
+
+	t := time.Now().UTC()
+	return q.withTx(ctx, t, func(tx *sqlx.Tx) (int, error) {
+		var waiting []string
+		if err := tx.SelectContext(ctx, &waiting, `SELECT id FROM queue WHERE status='WAITING' AND `+cond, args...); err != nil {
+			return 0, err
+		}
+
+		n, err := execCount(ctx, tx, query+cond, append([]interface{}{t}, args...)...)
+		if err != nil {
+			return 0, err
+		}
+
+		for len(waiting) > 0 {
+			selectQuery, selectArgs, err := sqlx.In(`SELECT id FROM queue WHERE status='WAITING' AND parent_id IN (?)`, waiting)
+			if err != nil {
+				return 0, err
+			}
+			var next []string
+			if err := tx.SelectContext(ctx, &next, selectQuery, selectArgs...); err != nil {
+				return 0, err
+			}
+
+			cancelQuery, cancelArgs, err := sqlx.In(query+`parent_id IN (?)`, t, waiting)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := tx.ExecContext(ctx, cancelQuery, cancelArgs...); err != nil {
+				return 0, err
+			}
+			waiting = next
+		}
+		return n, nil
+	})
+}
+
+func (q *sqlQueue) retry(ctx context.Context, cond string, args ...interface{}) (int, error) {
+	return q.withTx(ctx, time.Now().UTC(), func(tx *sqlx.Tx) (int, error) {
+		return retryTx(ctx, tx, cond, args...)
+	})
+}
+
+// delete removes the items matching the condition. Groups finished by
+// deleting their last unfinished items are recorded for finalization since
+// sweeps only notice groups with updated items. Items waiting on the deleted
+// items are touched so that they are resolved.
+func (q *sqlQueue) delete(ctx context.Context, cond string, args ...interface{}) (int, error) {
+	touchQuery := `UPDATE queue SET updated_at=?
+		WHERE status IN ('BLOCKED', 'WAITING') AND (
+			id IN (SELECT item_id FROM dependencies WHERE parent_id IN (SELECT id FROM queue WHERE ` + cond + `))
+			OR id IN (SELECT parent_id FROM queue WHERE ` + cond + `)
+		)`
+
+	fns := q.finalizers()
+	t := time.Now().UTC()
+	return q.withTx(ctx, t, func(tx *sqlx.Tx) (int, error) {
+		var groups []groupType
+		if len(fns) > 0 {
+			if err := tx.SelectContext(ctx, &groups, `SELECT DISTINCT group_id, type FROM queue WHERE `+cond, args...); err != nil {
+				return 0, err
+			}
+		}
+
+		touchArgs := append(append([]interface{}{t}, args...), args...)
+		if _, err := tx.ExecContext(ctx, touchQuery, touchArgs...); err != nil {
+			return 0, err
+		}
+
+		n, err := execCount(ctx, tx, `DELETE FROM queue WHERE `+cond, args...)
+		if err != nil {
+			return 0, err
+		}
+		return n, recordFinished(ctx, tx, fns, groups, t)
+	})
+}
+
+func retryTx(ctx context.Context, tx *sqlx.Tx, cond string, args ...interface{}) (int, error) {
+	query := `UPDATE queue
+		SET status=CASE WHEN EXISTS (SELECT 1 FROM dependencies WHERE item_id=queue.id) THEN 'BLOCKED' ELSE 'PENDING' END,
+		    attempts=0, last_error=NULL, result=NULL,
+		    progress=0, progress_message='', next_attempt_at=?, updated_at=?
+		WHERE status IN (` + sqlList(terminalStatuses) + `) AND ` + cond
+
+	t := time.Now().UTC()
+	return execCount(ctx, tx, query, append([]interface{}{t, t}, args...)...)
+}
+
+// expectOne converts the result of a single item update into ErrNotFound
+// or ErrInvalidStatus if no item was updated.
+func (q *sqlQueue) expectOne(ctx context.Context, id string, n int, err error) error {
+	if err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	if _, err := q.Get(ctx, id); err != nil {
+		return err
+	}
+	return ErrInvalidStatus
+}
+
+// withTx runs fn within a transaction that is committed if fn succeeds.
+// Items updated by fn must be stamped with t or later to be resolved.
+func (q *sqlQueue) withTx(ctx context.Context, t time.Time, fn func(tx *sqlx.Tx) (int, error)) (int, error) {
+	tx, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	n, err := fn(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// changes made by fn may have finished the parents of blocked items
+	// or the children of waiting items.
+	if err := q.resolve(ctx, tx, t); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func execCount(ctx context.Context, tx sqlx.ExecerContext, query string, args ...interface{}) (int, error) {
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// filterClause returns the SQL condition and the arguments for the filter.
+func filterClause(f Filter) (string, []interface{}, error) {
+	if f.IsEmpty() {
+		return "", nil, errEmptyFilter
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, field := range [][2]string{{"group_id", f.GroupID}, {"type", f.Type}, {"status", f.Status}} {
+		if field[1] != "" {
+			conds = append(conds, field[0]+"=?")
+			args = append(args, field[1])
+		}
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
@@ -0,0 +1,225 @@
+package genie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// breakerHolds is the condition on an item (in 'queue') that the circuit
+// breaker of its type holds it, i.e., the breaker is open or is half-open
+// with the probe owned by another worker. Takes the worker ID as argument.
+const breakerHolds = `EXISTS (SELECT 1 FROM breakers b WHERE b.type = queue.type
+		AND (b.state = 'OPEN' OR (b.state = 'HALF_OPEN' AND b.probe_owner != ?)))`
+
+// Breakers returns the state of the configured circuit breakers ordered by
+// type.
+func (q *sqlQueue) Breakers(ctx context.Context) ([]BreakerState, error) {
+	types := make([]string, 0, len(q.opts.Breakers))
+	for typ := range q.opts.Breakers {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	t := time.Now().UTC()
+	states := make([]BreakerState, 0, len(types))
+	for _, typ := range types {
+		b := q.opts.Breakers[typ]
+		rec, err := getBreaker(ctx, q.db, typ)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts, failures, err := breakerWindow(ctx, q.db, rec, b, t)
+		if err != nil {
+			return nil, err
+		}
+
+		state := BreakerState{Type: typ, State: rec.State, Attempts: attempts, Failures: failures}
+		if rec.State != BreakerClosed && rec.OpenedAt.Valid {
+			state.OpenedAt = rec.OpenedAt.Time.Local()
+			state.ProbeAt = state.OpenedAt.Add(b.cooldown())
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// tripBreaker updates the circuit breaker of the type with the outcome of
+// an attempt. A half-open breaker closes on success and opens again on
+// failure. A closed breaker opens on failure if the failure rate within the
+// window reaches the threshold.
+func (q *sqlQueue) tripBreaker(ctx context.Context, typ, outcome string, fnErr error) error {
+	const closeQuery = `UPDATE breakers SET state='CLOSED', probe_owner=NULL, closed_at=?, updated_at=?
+		WHERE type=? AND state='HALF_OPEN'`
+
+	const reopenQuery = `UPDATE breakers SET state='OPEN', probe_owner=NULL, opened_at=?, updated_at=?
+		WHERE type=? AND state='HALF_OPEN'`
+
+	const openQuery = `INSERT INTO breakers (type, state, opened_at, updated_at) VALUES (?, 'OPEN', ?, ?)
+		ON CONFLICT (type) DO UPDATE SET state='OPEN', opened_at=excluded.opened_at, updated_at=excluded.updated_at
+		WHERE breakers.state='CLOSED'`
+
+	b, ok := q.opts.Breakers[typ]
+	if !ok || b.Threshold <= 0 || outcome == StatusCancelled || errors.Is(fnErr, ErrSkip) {
+		return nil
+	}
+
+	t := time.Now().UTC()
+	if fnErr == nil {
+		_, err := q.db.ExecContext(ctx, closeQuery, t, t, typ)
+		return err
+	}
+
+	if n, err := execCount(ctx, q.db, reopenQuery, t, t, typ); err != nil || n > 0 {
+		return err
+	}
+
+	rec, err := getBreaker(ctx, q.db, typ)
+	if err != nil || rec.State != BreakerClosed {
+		return err
+	}
+
+	attempts, failures, err := breakerWindow(ctx, q.db, rec, b, t)
+	if err != nil {
+		return err
+	} else if attempts < b.minAttempts() || float64(failures)/float64(attempts) < b.Threshold {
+		return nil
+	}
+
+	if n, err := execCount(ctx, q.db, openQuery, typ, t, t); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("circuit breaker of '%s' opened, %d of %d attempts failed", typ, failures, attempts)
+	}
+	return nil
+}
+
+// probeBreakers half-opens the open circuit breakers whose cooldown has
+// passed and executes a single item of the type as the probe. Only one
+// worker across all processes probes a breaker at a time. The breaker is
+// opened again for another cooldown if there was nothing to probe or the
+// probe was inconclusive (e.g., skipped).
+func (q *sqlQueue) probeBreakers(ctx context.Context) error {
+	const halfOpenQuery = `UPDATE breakers SET state='HALF_OPEN', probe_owner=?, updated_at=?
+		WHERE type=? AND ((state='OPEN' AND opened_at <= ?) OR (state='HALF_OPEN' AND updated_at <= ?))`
+
+	const revertQuery = `UPDATE breakers SET state='OPEN', probe_owner=NULL, opened_at=?, updated_at=?
+		WHERE type=? AND state='HALF_OPEN' AND probe_owner=?`
+
+	for _, typ := range q.types {
+		b, ok := q.opts.Breakers[typ]
+		if !ok || b.Threshold <= 0 {
+			continue
+		} else if ctx.Err() != nil {
+			return nil
+		}
+
+		rec, err := getBreaker(ctx, q.db, typ)
+		if err != nil {
+			return err
+		}
+
+		// a half-open breaker whose probe should have finished by now was
+		// abandoned (e.g., the worker crashed).
+		t := time.Now().UTC()
+		cooledDown, abandoned := t.Add(-b.cooldown()), t.Add(-q.opts.FnTimeout-q.opts.LeaseTimeout)
+		switch rec.State {
+		case BreakerOpen:
+			if !rec.OpenedAt.Valid || rec.OpenedAt.Time.After(cooledDown) {
+				continue
+			}
+		case BreakerHalfOpen:
+			if rec.UpdatedAt.After(abandoned) {
+				continue
+			}
+		default:
+			continue
+		}
+
+		n, err := execCount(ctx, q.db, halfOpenQuery, q.opts.WorkerID, t, typ, cooledDown, abandoned)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			continue
+		}
+
+		records, err := q.selectDue(ctx, []string{typ}, true)
+		if err != nil {
+			log.Printf("failed to read probe for '%s': %v", typ, err)
+		} else if len(records) > 0 {
+			if err := q.processRecord(ctx, records[0], q.handle); err != nil {
+				log.Printf("failed to process probe '%s': %v", records[0].ID, err)
+			}
+		}
+
+		t = time.Now().UTC()
+		if _, err := q.db.ExecContext(detach(ctx), revertQuery, t, t, typ, q.opts.WorkerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBreaker returns the circuit breaker of the type. Breakers are CLOSED
+// until opened for the first time.
+func getBreaker(ctx context.Context, db sqlx.QueryerContext, typ string) (sqlBreaker, error) {
+	rec := sqlBreaker{Type: typ, State: BreakerClosed}
+	err := sqlx.GetContext(ctx, db, &rec, `SELECT * FROM breakers WHERE type=?`, typ)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return rec, err
+	}
+	return rec, nil
+}
+
+// breakerWindow returns the number of attempts and failures of items of the
+// type within the sliding window, ignoring attempts made before the breaker
+// last closed.
+func breakerWindow(ctx context.Context, db sqlx.QueryerContext, rec sqlBreaker, b Breaker, t time.Time) (int, int, error) {
+	const query = `SELECT count(*) AS attempts, count(a.error) AS failures
+		FROM attempts a JOIN queue q ON q.id = a.item_id
+		WHERE q.type = ? AND a.ended_at >= ? AND a.outcome NOT IN ('SKIPPED', 'CANCELLED')`
+
+	since := t.Add(-b.Window)
+	if rec.ClosedAt.Valid && rec.ClosedAt.Time.After(since) {
+		since = rec.ClosedAt.Time
+	}
+
+	var res struct {
+		Attempts int `db:"attempts"`
+		Failures int `db:"failures"`
+	}
+	if err := sqlx.GetContext(ctx, db, &res, query, rec.Type, since.UTC()); err != nil {
+		return 0, 0, err
+	}
+	return res.Attempts, res.Failures, nil
+}
+
+func (b Breaker) minAttempts() int {
+	if b.MinAttempts <= 0 {
+		return 1
+	}
+	return b.MinAttempts
+}
+
+func (b Breaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return b.Window
+	}
+	return b.Cooldown
+}
+
+// sqlBreaker should always match the breakers table.
+type sqlBreaker struct {
+	Type       string         `db:"type"`
+	State      string         `db:"state"`
+	ProbeOwner sql.NullString `db:"probe_owner"`
+	OpenedAt   sql.NullTime   `db:"opened_at"`
+	ClosedAt   sql.NullTime   `db:"closed_at"`
+	UpdatedAt  time.Time      `db:"updated_at"`
+}
@@ -0,0 +1,166 @@
+package genie
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Dependencies returns the dependencies declared by items in the group.
+func (q *sqlQueue) Dependencies(ctx context.Context, groupID string) ([]Dependency, error) {
+	const query = `SELECT d.item_id, d.parent_id FROM dependencies d
+		JOIN queue ON queue.id = d.item_id
+		WHERE queue.group_id=?
+		ORDER BY d.item_id, d.parent_id`
+
+	var deps []Dependency
+	if err := q.db.SelectContext(ctx, &deps, query, groupID); err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// parentsOf returns the IDs of items the given item depends on.
+func (q *sqlQueue) parentsOf(ctx context.Context, id string) ([]string, error) {
+	var parents []string
+	err := q.db.SelectContext(ctx, &parents, `SELECT parent_id FROM dependencies WHERE item_id=? ORDER BY parent_id`, id)
+	return parents, err
+}
+
+// findCycle returns the ID of a parent through which the item would end up
+// depending on itself, or empty string if there is none.
+func findCycle(ctx context.Context, tx *sqlx.Tx, id string, parents []string) (string, error) {
+	for _, parent := range parents {
+		seen := map[string]bool{}
+		frontier := []string{parent}
+		for len(frontier) > 0 {
+			for _, p := range frontier {
+				if p == id {
+					return parent, nil
+				}
+				seen[p] = true
+			}
+
+			query, args, err := sqlx.In(`SELECT DISTINCT parent_id FROM dependencies WHERE item_id IN (?)`, frontier)
+			if err != nil {
+				return "", err
+			}
+
+			var next []string
+			if err := tx.SelectContext(ctx, &next, query, args...); err != nil {
+				return "", err
+			}
+
+			frontier = frontier[:0]
+			for _, p := range next {
+				if !seen[p] {
+					frontier = append(frontier, p)
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// setDependencies replaces the dependencies of the item.
+func setDependencies(ctx context.Context, tx *sqlx.Tx, id string, parents []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM dependencies WHERE item_id=?`, id); err != nil {
+		return err
+	}
+
+	for _, parent := range parents {
+		const query = `INSERT OR IGNORE INTO dependencies (item_id, parent_id) VALUES (?, ?)`
+		if _, err := tx.ExecContext(ctx, query, id, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve updates the items waiting on other items after changes within
+// the tx. Only the items updated since the given time and those waiting on
+// them are considered. Dependencies are resolved first since failing
+// dependents may finish the children of waiting items.
+func (q *sqlQueue) resolve(ctx context.Context, tx *sqlx.Tx, since time.Time) error {
+	if err := q.resolveDependencies(ctx, tx, since); err != nil {
+		return err
+	}
+	return resolveChildren(ctx, tx, since)
+}
+
+// resolveChildren moves WAITING items whose children are all finished to
+// PENDING so that they are invoked again with the outcomes. Attempts are
+// reset so that the resumed invocation has all the attempts of the item.
+// Only the items updated since the given time and the parents of such items
+// are considered.
+func resolveChildren(ctx context.Context, tx *sqlx.Tx, since time.Time) error {
+	query := `UPDATE queue
+		SET status='PENDING', attempts=0, next_attempt_at=?, updated_at=?
+		WHERE id IN (
+			SELECT id FROM queue WHERE updated_at >= ?
+			UNION SELECT parent_id FROM queue WHERE updated_at >= ? AND parent_id IS NOT NULL
+		) AND +status='WAITING' AND NOT EXISTS (
+			SELECT 1 FROM queue c WHERE c.parent_id = queue.id AND c.status NOT IN (` + sqlList(terminalStatuses) + `)
+		)`
+
+	t := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, query, t, t, since, since); err != nil {
+		return fmt.Errorf("failed to resume waiting items: %w", err)
+	}
+	return nil
+}
+
+// resolveDependencies moves BLOCKED items whose parents are all DONE to
+// PENDING. Items with a parent that can no longer become DONE are failed
+// or skipped as per the policy, which may in turn cascade to their own
+// dependents. Only the items updated since the given time and the dependents
+// of such items are considered.
+func (q *sqlQueue) resolveDependencies(ctx context.Context, tx *sqlx.Tx, since time.Time) error {
+	// touched selects the items updated since the given time and their
+	// dependents. Items failed by the cascade are touched in turn. Status
+	// is compared with '+' so that the update is driven by these items
+	// rather than the index of all blocked items.
+	const touched = `id IN (
+			SELECT id FROM queue WHERE updated_at >= ?
+			UNION SELECT d.item_id FROM dependencies d JOIN queue p ON p.id = d.parent_id WHERE p.updated_at >= ?
+		)`
+
+	// unsatisfiable selects the parents of the blocked item (in 'queue')
+	// that will never be DONE.
+	const unsatisfiable = `FROM dependencies d LEFT JOIN queue p ON p.id = d.parent_id
+		WHERE d.item_id = queue.id AND (p.id IS NULL OR p.status IN ('FAILED', 'SKIPPED', 'CANCELLED', 'EXPIRED'))`
+
+	const cascadeQuery = `UPDATE queue
+		SET status=?, updated_at=?,
+		    last_error=(SELECT 'dependency ''' || d.parent_id || ''' is ' || coalesce(p.status, 'missing') ` + unsatisfiable + ` LIMIT 1)
+		WHERE ` + touched + ` AND +status='BLOCKED' AND EXISTS (SELECT 1 ` + unsatisfiable + `)`
+
+	const unblockQuery = `UPDATE queue
+		SET status='PENDING', updated_at=?
+		WHERE ` + touched + ` AND +status='BLOCKED' AND NOT EXISTS (
+			SELECT 1 FROM dependencies d LEFT JOIN queue p ON p.id = d.parent_id
+			WHERE d.item_id = queue.id AND (p.id IS NULL OR p.status != 'DONE')
+		)`
+
+	status := StatusFailed
+	if q.opts.DependencyPolicy == DependencySkip {
+		status = StatusSkipped
+	}
+
+	t := time.Now().UTC()
+	for {
+		n, err := execCount(ctx, tx, cascadeQuery, status, t, since, since)
+		if err != nil {
+			return fmt.Errorf("failed to cascade dependency failures: %w", err)
+		} else if n == 0 {
+			break
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, unblockQuery, t, since, since); err != nil {
+		return fmt.Errorf("failed to unblock dependents: %w", err)
+	}
+	return nil
+}
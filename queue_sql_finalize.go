@@ -0,0 +1,214 @@
+package genie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Finalizer keys identify a registered finalizer in the finalizations table.
+const (
+	finalizerTypePrefix  = "type:"
+	finalizerGroupPrefix = "group:"
+)
+
+// finalizers returns the finalizers registered with this instance by key.
+func (q *sqlQueue) finalizers() map[string]Finalizer {
+	fns := map[string]Finalizer{}
+	for typ, fn := range q.opts.TypeFinalizers {
+		fns[finalizerTypePrefix+typ] = fn
+	}
+	for groupID, fn := range q.opts.GroupFinalizers {
+		fns[finalizerGroupPrefix+groupID] = fn
+	}
+	return fns
+}
+
+// finalizeGroups records the groups that finished since the last sweep for
+// the registered finalizers and invokes the finalizers that are due.
+func (q *sqlQueue) finalizeGroups(ctx context.Context) error {
+	fns := q.finalizers()
+	if len(fns) == 0 {
+		return nil
+	}
+
+	if err := q.sweepGroups(ctx, fns); err != nil {
+		return fmt.Errorf("failed to find finished groups: %w", err)
+	}
+
+	keys := make([]string, 0, len(fns))
+	for key := range fns {
+		keys = append(keys, key)
+	}
+
+	query, args, err := sqlx.In(`SELECT group_id, finalizer FROM finalizations
+		WHERE (status='PENDING' OR (status='RUNNING' AND lease_expires_at < ?)) AND finalizer IN (?)
+		ORDER BY created_at`, time.Now().UTC(), keys)
+	if err != nil {
+		return err
+	}
+
+	var due []struct {
+		GroupID   string `db:"group_id"`
+		Finalizer string `db:"finalizer"`
+	}
+	if err := q.db.SelectContext(ctx, &due, query, args...); err != nil {
+		return err
+	}
+
+	for _, f := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := q.finalize(ctx, f.GroupID, f.Finalizer, fns[f.Finalizer]); err != nil {
+			log.Printf("failed to finalize group '%s' with '%s': %v", f.GroupID, f.Finalizer, err)
+		}
+	}
+	return nil
+}
+
+// sweepGroups records the finalizations due for groups that had updates
+// since the last sweep and have no unfinished items. The first sweep
+// considers all groups.
+func (q *sqlQueue) sweepGroups(ctx context.Context, fns map[string]Finalizer) error {
+	const query = `SELECT DISTINCT group_id, type FROM queue
+		WHERE group_id IN (SELECT group_id FROM queue WHERE updated_at >= ? AND group_id != '')`
+
+	t := time.Now().UTC()
+	since := q.sweptAt
+	if !since.IsZero() {
+		// allow for transactions that committed after the last sweep with
+		// an earlier update time.
+		since = since.Add(-q.opts.LeaseTimeout)
+	}
+
+	var groups []groupType
+	if err := q.db.SelectContext(ctx, &groups, query, since); err != nil {
+		return err
+	}
+
+	if err := recordFinished(ctx, q.db, fns, groups, t); err != nil {
+		return err
+	}
+	q.sweptAt = t
+	return nil
+}
+
+// groupType is a group along with a type of items it has (or had).
+type groupType struct {
+	GroupID string `db:"group_id"`
+	Type    string `db:"type"`
+}
+
+// recordFinished records the finalizations due for the groups that have
+// no unfinished items. The empty group is never finalized.
+func recordFinished(ctx context.Context, db sqlx.ExtContext, fns map[string]Finalizer, groups []groupType, t time.Time) error {
+	finishedQuery := `SELECT NOT EXISTS (
+		SELECT 1 FROM queue WHERE group_id=? AND status NOT IN (` + sqlList(terminalStatuses) + `)
+	)`
+
+	const insertQuery = `INSERT OR IGNORE INTO finalizations (group_id, finalizer, status, created_at)
+		VALUES (?, ?, 'PENDING', ?)`
+
+	finished := map[string]bool{}
+	for _, g := range groups {
+		if g.GroupID == "" {
+			continue
+		}
+
+		done, ok := finished[g.GroupID]
+		if !ok {
+			if err := sqlx.GetContext(ctx, db, &done, finishedQuery, g.GroupID); err != nil {
+				return err
+			}
+			finished[g.GroupID] = done
+		}
+		if !done {
+			continue
+		}
+
+		for _, key := range []string{finalizerTypePrefix + g.Type, finalizerGroupPrefix + g.GroupID} {
+			if _, ok := fns[key]; !ok {
+				continue
+			}
+			if _, err := db.ExecContext(ctx, insertQuery, g.GroupID, key, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finalize claims the finalization of the group and invokes fn. fn is given
+// up to FnTimeout like handlers so that it cannot hold up the Run loop. The
+// finalization is recorded as DONE or FAILED along with the error from fn.
+func (q *sqlQueue) finalize(ctx context.Context, groupID, key string, fn Finalizer) error {
+	const claimQuery = `UPDATE finalizations SET status='RUNNING', worker_id=?, lease_expires_at=?
+		WHERE group_id=? AND finalizer=? AND (status='PENDING' OR (status='RUNNING' AND lease_expires_at < ?))`
+
+	const extendQuery = `UPDATE finalizations SET lease_expires_at=?
+		WHERE group_id=? AND finalizer=? AND status='RUNNING' AND worker_id=?`
+
+	const finishQuery = `UPDATE finalizations SET status=?, error=?, finished_at=?, lease_expires_at=NULL
+		WHERE group_id=? AND finalizer=? AND status='RUNNING' AND worker_id=?`
+
+	t := time.Now().UTC()
+	n, err := execCount(ctx, q.db, claimQuery, q.opts.WorkerID, t.Add(q.opts.LeaseTimeout), groupID, key, t)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	stats, err := q.groupStats(ctx, groupID)
+	if err != nil {
+		return err
+	}
+
+	fnCtx, cancel := context.WithTimeout(ctx, q.opts.FnTimeout)
+	defer cancel()
+
+	stop := q.keepAlive(ctx, cancel, func(ctx context.Context, expiry time.Time) (int, error) {
+		return execCount(ctx, q.db, extendQuery, expiry, groupID, key, q.opts.WorkerID)
+	})
+	fnErr := safeFinalize(fnCtx, fn, *stats, q)
+	stop()
+
+	status, errMsg := StatusDone, ""
+	if fnErr != nil {
+		status, errMsg = StatusFailed, fnErr.Error()
+	}
+
+	// outcome must be persisted even if ctx was cancelled while draining.
+	if n, err := execCount(detach(ctx), q.db, finishQuery, status, errMsg, time.Now().UTC(),
+		groupID, key, q.opts.WorkerID); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("lease lost while finalizing")
+	}
+	return fnErr
+}
+
+// groupStats returns the statistics of the group across all types. Stats are
+// empty if all the items of the group were deleted.
+func (q *sqlQueue) groupStats(ctx context.Context, groupID string) (*Stats, error) {
+	query := `SELECT CASE WHEN count(DISTINCT type) = 1 THEN min(type) ELSE '' END AS type,
+	       group_id, ` + statsColumns + `
+	FROM queue
+	WHERE group_id=?
+	GROUP BY group_id`
+
+	stats := Stats{GroupID: groupID}
+	if err := q.db.GetContext(ctx, &stats, query, groupID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func safeFinalize(ctx context.Context, fn Finalizer, stats Stats, q Queue) (err error) {
+	defer recoverPanic(&err)
+	return fn(ctx, stats, q)
+}
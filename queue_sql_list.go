@@ -0,0 +1,163 @@
+package genie
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// List returns a page of items matching the query using keyset pagination
+// on the sort field and the item ID.
+func (q *sqlQueue) List(ctx context.Context, query Query) (*Page, error) {
+	sortBy := query.SortBy
+	if sortBy == "" {
+		sortBy = SortCreatedAt
+	} else if sortBy != SortCreatedAt && sortBy != SortUpdatedAt && sortBy != SortID {
+		return nil, fmt.Errorf("cannot sort by '%s'", sortBy)
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	conds, args := queryClause(query)
+	if query.Cursor != "" {
+		cur, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		op := ">"
+		if query.Desc {
+			op = "<"
+		}
+
+		if sortBy == SortID {
+			conds = append(conds, "id "+op+" ?")
+			args = append(args, cur.ID)
+		} else {
+			conds = append(conds, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", sortBy, op, sortBy, op))
+			args = append(args, cur.Time, cur.Time, cur.ID)
+		}
+	}
+
+	order := "ASC"
+	if query.Desc {
+		order = "DESC"
+	}
+
+	stmt := `SELECT * FROM queue`
+	if len(conds) > 0 {
+		stmt += ` WHERE ` + strings.Join(conds, " AND ")
+	}
+	if sortBy == SortID {
+		stmt += fmt.Sprintf(` ORDER BY id %s`, order)
+	} else {
+		stmt += fmt.Sprintf(` ORDER BY %s %s, id %s`, sortBy, order, order)
+	}
+	stmt += fmt.Sprintf(` LIMIT %d`, limit+1)
+
+	var records []sqlQueueItem
+	if err := q.db.SelectContext(ctx, &records, stmt, args...); err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	if len(records) > limit {
+		records = records[:limit]
+		last := records[limit-1]
+
+		cur := listCursor{ID: last.ID, Time: last.CreatedAt}
+		if sortBy == SortUpdatedAt {
+			cur.Time = last.UpdatedAt
+		}
+		page.NextCursor = cur.encode()
+	}
+
+	page.Items = make([]Item, len(records), len(records))
+	for i, rec := range records {
+		page.Items[i] = rec.Item()
+	}
+	return page, nil
+}
+
+// queryClause returns the SQL conditions and arguments for the query
+// filters, excluding the cursor.
+func queryClause(query Query) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if !query.Filter.IsEmpty() {
+		cond, filterArgs, _ := filterClause(query.Filter)
+		conds = append(conds, cond)
+		args = append(args, filterArgs...)
+	}
+
+	if query.IDPrefix != "" {
+		conds = append(conds, `id LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(query.IDPrefix)+"%")
+	}
+
+	if query.ErrorContains != "" {
+		conds = append(conds, `instr(last_error, ?) > 0`)
+		args = append(args, query.ErrorContains)
+	}
+
+	timeRanges := []struct {
+		col   string
+		op    string
+		value time.Time
+	}{
+		{col: "created_at", op: ">=", value: query.CreatedAfter},
+		{col: "created_at", op: "<", value: query.CreatedBefore},
+		{col: "updated_at", op: ">=", value: query.UpdatedAfter},
+		{col: "updated_at", op: "<", value: query.UpdatedBefore},
+	}
+	for _, tr := range timeRanges {
+		if !tr.value.IsZero() {
+			conds = append(conds, tr.col+" "+tr.op+" ?")
+			args = append(args, tr.value.UTC())
+		}
+	}
+
+	return conds, args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// listCursor is the position after which the next page starts. It is
+// handed out to the clients as an opaque string.
+type listCursor struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"t,omitempty"`
+}
+
+func (c listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var cur listCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	cur.Time = cur.Time.UTC()
+	return &cur, nil
+}
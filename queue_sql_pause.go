@@ -0,0 +1,51 @@
+package genie
+
+import (
+	"context"
+	"time"
+)
+
+// pauseHolds is the condition on an item (in 'queue') that its type or group
+// is paused.
+const pauseHolds = `EXISTS (SELECT 1 FROM pauses p
+		WHERE (p.type != '' AND p.type = queue.type) OR (p.group_id != '' AND p.group_id = queue.group_id))`
+
+// Pause records the pause of the type or group. Pausing again updates the
+// reason.
+func (q *sqlQueue) Pause(ctx context.Context, p Pause) error {
+	const upsertQuery = `INSERT INTO pauses (type, group_id, reason, paused_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (type, group_id) DO UPDATE SET reason=excluded.reason`
+
+	if err := p.validate(); err != nil {
+		return err
+	}
+	_, err := q.db.ExecContext(ctx, upsertQuery, p.Type, p.GroupID, p.Reason, time.Now().UTC())
+	return err
+}
+
+// Resume removes the pause of the type or group.
+func (q *sqlQueue) Resume(ctx context.Context, p Pause) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	n, err := execCount(ctx, q.db, `DELETE FROM pauses WHERE type=? AND group_id=?`, p.Type, p.GroupID)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Pauses returns the current pauses, types first.
+func (q *sqlQueue) Pauses(ctx context.Context) ([]Pause, error) {
+	var pauses []Pause
+	if err := q.db.SelectContext(ctx, &pauses, `SELECT * FROM pauses ORDER BY group_id, type`); err != nil {
+		return nil, err
+	}
+	for i := range pauses {
+		pauses[i].PausedAt = pauses[i].PausedAt.Local()
+	}
+	return pauses, nil
+}
@@ -0,0 +1,120 @@
+package genie
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Rate limit keys identify a token bucket in the rate_limits table.
+const (
+	rateLimitTypePrefix  = "type:"
+	rateLimitGroupPrefix = "group:"
+)
+
+// rateLimits returns the enabled rate limits by key.
+func (q *sqlQueue) rateLimits() map[string]Limit {
+	limits := map[string]Limit{}
+	for typ, limit := range q.opts.TypeRateLimits {
+		if limit.Interval > 0 {
+			limits[rateLimitTypePrefix+typ] = limit
+		}
+	}
+	for groupID, limit := range q.opts.GroupRateLimits {
+		if limit.Interval > 0 {
+			limits[rateLimitGroupPrefix+groupID] = limit
+		}
+	}
+	return limits
+}
+
+// rateLimitsOf returns the enabled rate limits that apply to the item by key.
+func (q *sqlQueue) rateLimitsOf(rec sqlQueueItem) map[string]Limit {
+	limits := map[string]Limit{}
+	if limit := q.opts.TypeRateLimits[rec.Type]; limit.Interval > 0 {
+		limits[rateLimitTypePrefix+rec.Type] = limit
+	}
+	if limit := q.opts.GroupRateLimits[rec.GroupID]; limit.Interval > 0 {
+		limits[rateLimitGroupPrefix+rec.GroupID] = limit
+	}
+	return limits
+}
+
+// exhaustedLimits returns the types and groups whose buckets currently have
+// no tokens, so that their items are not fetched.
+func (q *sqlQueue) exhaustedLimits(ctx context.Context) (types, groups []string, err error) {
+	limits := q.rateLimits()
+	if len(limits) == 0 {
+		return nil, nil, nil
+	}
+
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+
+	query, args, err := sqlx.In(`SELECT key, tokens, refilled_at FROM rate_limits WHERE key IN (?)`, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buckets []struct {
+		Key        string  `db:"key"`
+		Tokens     float64 `db:"tokens"`
+		RefilledAt float64 `db:"refilled_at"`
+	}
+	if err := q.db.SelectContext(ctx, &buckets, query, args...); err != nil {
+		return nil, nil, err
+	}
+
+	now := unixSeconds(time.Now())
+	for _, b := range buckets {
+		limit := limits[b.Key]
+		tokens := math.Min(limit.burst(), b.Tokens+math.Max(0, now-b.RefilledAt)*limit.rate())
+		if tokens >= 1 {
+			continue
+		}
+
+		if strings.HasPrefix(b.Key, rateLimitTypePrefix) {
+			types = append(types, strings.TrimPrefix(b.Key, rateLimitTypePrefix))
+		} else {
+			groups = append(groups, strings.TrimPrefix(b.Key, rateLimitGroupPrefix))
+		}
+	}
+	return types, groups, nil
+}
+
+// takeToken takes a token from the bucket within the tx after refilling it
+// for the time elapsed since the last refill. Returns false if the bucket
+// has no tokens.
+func takeToken(ctx context.Context, tx *sqlx.Tx, key string, limit Limit, t time.Time) (bool, error) {
+	const insertQuery = `INSERT OR IGNORE INTO rate_limits (key, tokens, refilled_at) VALUES (?, ?, ?)`
+
+	const takeQuery = `UPDATE rate_limits
+		SET tokens = min(?1, tokens + max(0, ?2 - refilled_at) * ?3) - 1, refilled_at = ?2
+		WHERE key = ?4 AND min(?1, tokens + max(0, ?2 - refilled_at) * ?3) >= 1`
+
+	now := unixSeconds(t)
+	if _, err := tx.ExecContext(ctx, insertQuery, key, limit.burst(), now); err != nil {
+		return false, err
+	}
+
+	n, err := execCount(ctx, tx, takeQuery, limit.burst(), now, limit.rate(), key)
+	return n > 0, err
+}
+
+// burst returns the capacity of the bucket. Defaults to 1.
+func (limit Limit) burst() float64 {
+	if limit.Burst <= 0 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+// rate returns the tokens added to the bucket per second.
+func (limit Limit) rate() float64 { return float64(time.Second) / float64(limit.Interval) }
+
+func unixSeconds(t time.Time) float64 { return float64(t.UnixNano()) / float64(time.Second) }
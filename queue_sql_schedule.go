@@ -0,0 +1,219 @@
+package genie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// errAlreadyFired aborts firing a schedule that was fired by another process.
+var errAlreadyFired = errors.New("schedule already fired")
+
+// PutSchedule creates the schedule or replaces the one with the same ID.
+// The next run is computed from the current time.
+func (q *sqlQueue) PutSchedule(ctx context.Context, s Schedule) (*Schedule, error) {
+	const upsertQuery = `INSERT INTO schedules
+		(id, cron, timezone, type, payload, group_id, missed_runs, disabled, next_run_at, created_at, updated_at)
+		VALUES (:id, :cron, :timezone, :type, :payload, :group_id, :missed_runs, :disabled, :next_run_at, :created_at, :updated_at)
+		ON CONFLICT (id) DO UPDATE SET
+			cron=excluded.cron, timezone=excluded.timezone, type=excluded.type, payload=excluded.payload,
+			group_id=excluded.group_id, missed_runs=excluded.missed_runs, disabled=excluded.disabled,
+			next_run_at=excluded.next_run_at, last_error=NULL, updated_at=excluded.updated_at`
+
+	cs, err := s.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Now().UTC()
+	rec := sqlSchedule{
+		ID:         s.ID,
+		Cron:       s.Cron,
+		Timezone:   s.Timezone,
+		Type:       s.Type,
+		Payload:    s.Payload,
+		GroupID:    s.GroupID,
+		MissedRuns: string(s.MissedRuns),
+		Disabled:   s.Disabled,
+		NextRunAt:  cs.next(t).UTC(),
+		CreatedAt:  t,
+		UpdatedAt:  t,
+	}
+	if rec.NextRunAt.IsZero() {
+		return nil, errors.New("cron expression never matches")
+	}
+
+	if _, err := q.db.NamedExecContext(ctx, upsertQuery, rec); err != nil {
+		return nil, err
+	}
+	return q.getSchedule(ctx, s.ID)
+}
+
+// Schedules returns all the schedules ordered by ID.
+func (q *sqlQueue) Schedules(ctx context.Context) ([]Schedule, error) {
+	var recs []sqlSchedule
+	if err := q.db.SelectContext(ctx, &recs, `SELECT * FROM schedules ORDER BY id`); err != nil {
+		return nil, err
+	}
+
+	schedules := make([]Schedule, len(recs))
+	for i, rec := range recs {
+		schedules[i] = rec.Schedule()
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule removes the schedule. Items already enqueued by it are
+// not affected.
+func (q *sqlQueue) DeleteSchedule(ctx context.Context, id string) error {
+	n, err := execCount(ctx, q.db, `DELETE FROM schedules WHERE id=?`, id)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (q *sqlQueue) getSchedule(ctx context.Context, id string) (*Schedule, error) {
+	var rec sqlSchedule
+	if err := q.db.GetContext(ctx, &rec, `SELECT * FROM schedules WHERE id=?`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	s := rec.Schedule()
+	return &s, nil
+}
+
+// fireSchedules enqueues the items of all the schedules that are due.
+func (q *sqlQueue) fireSchedules(ctx context.Context) error {
+	const dueQuery = `SELECT * FROM schedules WHERE disabled=0 AND next_run_at <= ? ORDER BY next_run_at`
+
+	var due []sqlSchedule
+	if err := q.db.SelectContext(ctx, &due, dueQuery, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	for _, rec := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := q.fireSchedule(ctx, rec); err != nil {
+			log.Printf("failed to fire schedule '%s': %v", rec.ID, err)
+		}
+	}
+	return nil
+}
+
+// fireSchedule enqueues items for the due runs of the schedule and moves it
+// to the next run. The update is conditional on the schedule not having
+// been fired by another process in the meantime, so that each run is
+// enqueued exactly once.
+func (q *sqlQueue) fireSchedule(ctx context.Context, rec sqlSchedule) error {
+	const updateQuery = `UPDATE schedules
+		SET next_run_at=?, last_run_at=?, last_error=?, updated_at=?
+		WHERE id=? AND next_run_at=? AND disabled=0`
+
+	s := rec.Schedule()
+	cs, err := s.compile()
+	if err != nil {
+		// e.g., timezone unavailable on this host. leave it to others.
+		return err
+	}
+
+	t := time.Now().UTC()
+	runs, next := cs.dueRuns(s, rec.NextRunAt.Add(-time.Second), t)
+	if next.IsZero() {
+		return errors.New("cron expression never matches")
+	}
+
+	var lastRun time.Time
+	var errs []string
+	_, err = q.withTx(ctx, t, func(tx *sqlx.Tx) (int, error) {
+		for _, run := range runs {
+			item, err := cs.item(s, run)
+			if err == nil {
+				err = q.pushScheduled(ctx, tx, item, t)
+			}
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			lastRun = run.UTC()
+		}
+
+		lastErr := sql.NullString{Valid: len(errs) > 0, String: strings.Join(errs, "; ")}
+		n, err := execCount(ctx, tx, updateQuery, next.UTC(), lastRun, lastErr, t, rec.ID, rec.NextRunAt)
+		if err != nil {
+			return 0, err
+		} else if n == 0 {
+			return 0, errAlreadyFired
+		}
+		return n, nil
+	})
+	if errors.Is(err, errAlreadyFired) {
+		return nil // fired by another process.
+	}
+	return err
+}
+
+// pushScheduled validates and stores the item enqueued by a schedule. Items
+// that already exist are left as is.
+func (q *sqlQueue) pushScheduled(ctx context.Context, tx *sqlx.Tx, item Item, t time.Time) error {
+	results, candidates := preparePush(ctx, q.opts.Interceptors, q.handle, []Item{item})
+	for _, res := range results {
+		if res.Status == PushInvalid {
+			return errors.New(res.Reason)
+		}
+	}
+
+	for _, c := range candidates {
+		if _, _, err := q.pushItem(ctx, tx, PushOptions{OnConflict: ConflictIgnore}, c.Item, "", t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqlSchedule struct {
+	ID         string         `db:"id"`
+	Cron       string         `db:"cron"`
+	Timezone   string         `db:"timezone"`
+	Type       string         `db:"type"`
+	Payload    string         `db:"payload"`
+	GroupID    string         `db:"group_id"`
+	MissedRuns string         `db:"missed_runs"`
+	Disabled   bool           `db:"disabled"`
+	NextRunAt  time.Time      `db:"next_run_at"`
+	LastRunAt  sql.NullTime   `db:"last_run_at"`
+	LastError  sql.NullString `db:"last_error"`
+	CreatedAt  time.Time      `db:"created_at"`
+	UpdatedAt  time.Time      `db:"updated_at"`
+}
+
+func (rec sqlSchedule) Schedule() Schedule {
+	s := Schedule{
+		ID:         rec.ID,
+		Cron:       rec.Cron,
+		Timezone:   rec.Timezone,
+		Type:       rec.Type,
+		Payload:    rec.Payload,
+		GroupID:    rec.GroupID,
+		MissedRuns: MissedRunPolicy(rec.MissedRuns),
+		Disabled:   rec.Disabled,
+		NextRunAt:  rec.NextRunAt.Local(),
+		LastError:  rec.LastError.String,
+		CreatedAt:  rec.CreatedAt.Local(),
+		UpdatedAt:  rec.UpdatedAt.Local(),
+	}
+	if rec.LastRunAt.Valid {
+		s.LastRunAt = rec.LastRunAt.Time.Local()
+	}
+	return s
+}
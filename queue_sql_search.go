@@ -0,0 +1,137 @@
+package genie
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const searchSchema = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS queue_fts USING fts5(
+		payload, result, last_error, content='queue', content_rowid='search_rowid'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS queue_fts_insert AFTER INSERT ON queue BEGIN
+		INSERT INTO queue_fts (rowid, payload, result, last_error)
+		VALUES (new.search_rowid, new.payload, new.result, new.last_error);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS queue_fts_delete AFTER DELETE ON queue BEGIN
+		INSERT INTO queue_fts (queue_fts, rowid, payload, result, last_error)
+		VALUES ('delete', old.search_rowid, old.payload, old.result, old.last_error);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS queue_fts_update AFTER UPDATE OF payload, result, last_error ON queue BEGIN
+		INSERT INTO queue_fts (queue_fts, rowid, payload, result, last_error)
+		VALUES ('delete', old.search_rowid, old.payload, old.result, old.last_error);
+		INSERT INTO queue_fts (rowid, payload, result, last_error)
+		VALUES (new.search_rowid, new.payload, new.result, new.last_error);
+	END;
+`
+
+// Matched terms in search snippets are enclosed in these control characters
+// so that they cannot be confused with the text of payloads.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// setupSearch creates the full-text index and the triggers that keep it in
+// sync with the queue. Existing items are indexed when the triggers are new
+// since the index may be missing items written while search was dropped.
+// Indexes created by older versions are keyed on the implicit rowid, which
+// VACUUM may renumber, and are recreated.
+func setupSearch(db *sqlx.DB) error {
+	var exists int
+	if err := db.Get(&exists, `SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name='queue_fts_insert'`); err != nil {
+		return err
+	}
+
+	var legacy int
+	if err := db.Get(&legacy, `SELECT count(*) FROM sqlite_master WHERE name='queue_fts' AND sql LIKE '%content_rowid=''rowid''%'`); err != nil {
+		return err
+	}
+	if legacy > 0 {
+		if err := teardownSearch(db); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`DROP TABLE queue_fts`); err != nil {
+			return err
+		}
+		exists = 0
+	}
+
+	if _, err := db.Exec(searchSchema); err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return fmt.Errorf("full-text search requires building with '-tags sqlite_fts5': %w", err)
+		}
+		return err
+	}
+
+	if exists == 0 {
+		_, err := db.Exec(`INSERT INTO queue_fts (queue_fts) VALUES ('rebuild')`)
+		return err
+	}
+	return nil
+}
+
+// teardownSearch drops the triggers so that writes do not maintain the
+// full-text index once search is dropped. The index is kept and rebuilt by
+// setupSearch if search is enabled again.
+func teardownSearch(db *sqlx.DB) error {
+	_, err := db.Exec(`
+		DROP TRIGGER IF EXISTS queue_fts_insert;
+		DROP TRIGGER IF EXISTS queue_fts_delete;
+		DROP TRIGGER IF EXISTS queue_fts_update;`)
+	return err
+}
+
+// Search returns items matching all the terms in text ranked by relevance.
+func (q *sqlQueue) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	if !q.opts.FullTextSearch {
+		return nil, ErrSearchDisabled
+	}
+
+	match := ftsQuery(text)
+	if match == "" {
+		return nil, nil
+	}
+
+	if limit <= 0 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	const query = `SELECT queue.*, snippet(queue_fts, -1, ?, ?, '...', 16) AS snippet
+		FROM queue_fts JOIN queue ON queue.search_rowid = queue_fts.rowid
+		WHERE queue_fts MATCH ?
+		ORDER BY rank
+		LIMIT ?`
+
+	var records []struct {
+		sqlQueueItem
+		Snippet string `db:"snippet"`
+	}
+	if err := q.db.SelectContext(ctx, &records, query, snippetStart, snippetEnd, match, limit); err != nil {
+		return nil, err
+	}
+
+	hits := make([]SearchHit, len(records), len(records))
+	for i, rec := range records {
+		hits[i] = SearchHit{Item: rec.Item(), Snippet: rec.Snippet}
+	}
+	return hits, nil
+}
+
+// ftsQuery quotes every term in the text so that FTS query syntax in user
+// input is matched literally. Terms are implicitly AND-ed.
+func ftsQuery(text string) string {
+	terms := strings.Fields(text)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " ")
+}
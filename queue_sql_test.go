@@ -0,0 +1,1573 @@
+package genie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"html/template"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueue(t *testing.T, h Handler, opts ...Option) *sqlQueue {
+	t.Helper()
+
+	opts = append([]Option{func(o *Options) { o.PollInt = 10 * time.Millisecond }}, opts...)
+	u := &url.URL{Scheme: "sqlite3", Host: filepath.Join(t.TempDir(), "genie.db")}
+	q, err := newSQLQueue(u, []string{"test"}, h, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+	return q
+}
+
+func pushTestItems(t *testing.T, q *sqlQueue, items ...Item) {
+	t.Helper()
+
+	results, err := q.Push(context.Background(), PushOptions{}, items...)
+	require.NoError(t, err)
+	for _, res := range results {
+		require.Equal(t, PushAccepted, res.Status, res.Reason)
+	}
+}
+
+func getTestItem(t *testing.T, q *sqlQueue, id string) sqlQueueItem {
+	t.Helper()
+
+	var rec sqlQueueItem
+	require.NoError(t, q.db.Get(&rec, `SELECT * FROM queue WHERE id=?`, id))
+	return rec
+}
+
+func TestSQLQueue_Run_drain(t *testing.T) {
+	t.Run("InFlightFinishes", func(t *testing.T) {
+		started := make(chan struct{})
+		q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			return []byte("ok"), ctx.Err()
+		}), DrainTimeout(time.Second))
+		pushTestItems(t, q, Item{ID: "1", Type: "test"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		require.NoError(t, q.Run(ctx))
+
+		rec := getTestItem(t, q, "1")
+		assert.Equal(t, StatusDone, rec.Status)
+		assert.Equal(t, "ok", rec.Result.String)
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		started := make(chan struct{})
+		q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}), DrainTimeout(50*time.Millisecond), func(o *Options) {
+			o.MaxAttempts = 3
+			o.FnTimeout = time.Minute
+		})
+		pushTestItems(t, q, Item{ID: "1", Type: "test"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		require.NoError(t, q.Run(ctx))
+
+		item, err := q.Get(context.Background(), "1")
+		require.NoError(t, err)
+		assert.Equal(t, StatusPending, item.Status)
+		assert.Equal(t, 1, item.Attempt)
+		assert.Equal(t, context.Canceled.Error(), item.LastError)
+	})
+}
+
+func TestSQLQueue_processRecord_panic(t *testing.T) {
+	panicky := HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		panic("boom")
+	})
+
+	table := []struct {
+		title  string
+		policy PanicPolicy
+		status string
+	}{
+		{title: "Retry", policy: PanicRetry, status: StatusPending},
+		{title: "Fail", policy: PanicFail, status: StatusFailed},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			q := newTestQueue(t, panicky, OnPanic(tt.policy), func(o *Options) { o.MaxAttempts = 3 })
+			pushTestItems(t, q, Item{ID: "1", Type: "test"})
+
+			panics := func() int64 {
+				if v, ok := metrics.Get(metricPanics).(*expvar.Int); ok {
+					return v.Value()
+				}
+				return 0
+			}
+			before := panics()
+			require.NoError(t, q.processRecord(context.Background(), getTestItem(t, q, "1"), q.handle))
+
+			rec := getTestItem(t, q, "1")
+			assert.Equal(t, tt.status, rec.Status)
+			assert.Contains(t, rec.LastError.String, "panic: boom")
+			assert.Contains(t, rec.LastError.String, "goroutine")
+			assert.Equal(t, before+1, panics())
+		})
+	}
+}
+
+func TestSQLQueue_Push_interceptors(t *testing.T) {
+	split := func(_ context.Context, item Item) ([]Item, error) {
+		if item.Payload == "bad" {
+			return nil, errors.New("bad payload")
+		}
+		var res []Item
+		for _, p := range strings.Split(item.Payload, ",") {
+			res = append(res, Item{Type: item.Type, GroupID: item.GroupID, Payload: p})
+		}
+		return res, nil
+	}
+
+	q := newTestQueue(t, HandlerFn(nil), Intercept(split, AssignID()))
+
+	results, err := q.Push(context.Background(), PushOptions{}, Item{ID: "x", Type: "test", Payload: "bad"})
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, []PushResult{{ID: "x", Status: PushInvalid, Reason: "bad payload"}}, results)
+
+	pushTestItems(t, q, Item{Type: "test", GroupID: "g", Payload: "a,b,c"})
+	var payloads []string
+	require.NoError(t, q.ForEach(context.Background(), "g", StatusPending, func(_ context.Context, item Item) error {
+		assert.NotEmpty(t, item.ID)
+		payloads = append(payloads, item.Payload)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, payloads)
+}
+
+func TestSQLQueue_Push_partial(t *testing.T) {
+	q := newTestQueue(t, HandlerFuncs{SanitizeFn: func(_ context.Context, item *Item) error {
+		if item.Payload == "" {
+			return errors.New("empty payload")
+		}
+		return nil
+	}})
+	pushTestItems(t, q, Item{ID: "1", Type: "test", Payload: "a"})
+
+	items := []Item{
+		{ID: "1", Type: "test", Payload: "a"},
+		{ID: "2", Type: "test", Payload: ""},
+		{ID: "3", Type: "test", Payload: "c"},
+	}
+
+	t.Run("AllOrNothing", func(t *testing.T) {
+		results, err := q.Push(context.Background(), PushOptions{}, items...)
+		assert.ErrorIs(t, err, ErrRejected)
+		assert.Equal(t, []PushResult{
+			{Index: 0, ID: "1", Status: PushDuplicate, Reason: "item with same id exists"},
+			{Index: 1, ID: "2", Status: PushInvalid, Reason: "empty payload"},
+			{Index: 2, ID: "3", Status: PushAborted},
+		}, results)
+
+		var count int
+		require.NoError(t, q.db.Get(&count, `SELECT count(*) FROM queue`))
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("BestEffort", func(t *testing.T) {
+		results, err := q.Push(context.Background(), PushOptions{BestEffort: true}, items...)
+		assert.NoError(t, err)
+		assert.Equal(t, []PushResult{
+			{Index: 0, ID: "1", Status: PushDuplicate, Reason: "item with same id exists"},
+			{Index: 1, ID: "2", Status: PushInvalid, Reason: "empty payload"},
+			{Index: 2, ID: "3", Status: PushAccepted},
+		}, results)
+		assert.Equal(t, "c", getTestItem(t, q, "3").Payload)
+	})
+}
+
+func TestSQLQueue_Push_conflicts(t *testing.T) {
+	push := func(t *testing.T, q *sqlQueue, opts PushOptions, item Item) PushResult {
+		results, err := q.Push(context.Background(), opts, item)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		return results[0]
+	}
+
+	q := newTestQueue(t, HandlerFn(nil))
+	pushTestItems(t, q,
+		Item{ID: "pending", Type: "test", Payload: "a"},
+		Item{ID: "done", Type: "test", Payload: "a"},
+	)
+	_, err := q.db.Exec(`UPDATE queue SET status='DONE', attempts=1 WHERE id='done'`)
+	require.NoError(t, err)
+
+	res := push(t, q, PushOptions{OnConflict: ConflictIgnore}, Item{ID: "pending", Type: "test", Payload: "b"})
+	assert.Equal(t, PushIgnored, res.Status)
+	assert.Equal(t, "a", getTestItem(t, q, "pending").Payload)
+
+	res = push(t, q, PushOptions{OnConflict: ConflictReplaceTerminal, BestEffort: true}, Item{ID: "pending", Type: "test", Payload: "b"})
+	assert.Equal(t, PushDuplicate, res.Status)
+
+	res = push(t, q, PushOptions{OnConflict: ConflictReplaceTerminal}, Item{ID: "done", Type: "test", Payload: "b"})
+	assert.Equal(t, PushReplaced, res.Status)
+	rec := getTestItem(t, q, "done")
+	assert.Equal(t, StatusPending, rec.Status)
+	assert.Equal(t, 0, rec.Attempts)
+	assert.Equal(t, "b", rec.Payload)
+
+	res = push(t, q, PushOptions{OnConflict: ConflictReplace}, Item{ID: "pending", Type: "test", Payload: "c"})
+	assert.Equal(t, PushReplaced, res.Status)
+	assert.Equal(t, "c", getTestItem(t, q, "pending").Payload)
+
+	// items in flight are never replaced.
+	for _, status := range []string{StatusRunning, StatusWaiting, StatusBlocked} {
+		_, err := q.db.Exec(`UPDATE queue SET status=? WHERE id='done'`, status)
+		require.NoError(t, err)
+		res = push(t, q, PushOptions{OnConflict: ConflictReplace, BestEffort: true}, Item{ID: "done", Type: "test", Payload: "d"})
+		assert.Equal(t, PushDuplicate, res.Status, status)
+		assert.Equal(t, "b", getTestItem(t, q, "done").Payload)
+	}
+
+	res = push(t, q, PushOptions{DedupeWindow: time.Minute}, Item{ID: "other", Type: "test", Payload: "c"})
+	assert.Equal(t, PushIgnored, res.Status)
+	assert.Contains(t, res.Reason, "'pending'")
+
+	// only conflicts on the ID are reported as duplicates.
+	_, err = q.db.Exec(`CREATE UNIQUE INDEX index_test_payload ON queue (payload)`)
+	require.NoError(t, err)
+	_, err = q.Push(context.Background(), PushOptions{}, Item{ID: "new", Type: "test", Payload: "c"})
+	assert.Error(t, err)
+}
+
+func TestSQLQueue_admin(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, HandlerFn(nil))
+	pushTestItems(t, q,
+		Item{ID: "1", Type: "test", GroupID: "g1", Payload: "a"},
+		Item{ID: "2", Type: "test", GroupID: "g1", Payload: "b"},
+		Item{ID: "3", Type: "test", GroupID: "g2", Payload: "c"},
+	)
+
+	_, err := q.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	item, err := q.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "a", item.Payload)
+	assert.Equal(t, StatusPending, item.Status)
+	assert.WithinDuration(t, time.Now(), item.CreatedAt, time.Minute)
+
+	require.NoError(t, q.Cancel(ctx, "1"))
+	assert.ErrorIs(t, q.Cancel(ctx, "1"), ErrInvalidStatus)
+	assert.Equal(t, StatusCancelled, getTestItem(t, q, "1").Status)
+
+	assert.ErrorIs(t, q.Retry(ctx, "2", nil), ErrInvalidStatus)
+	payload := "edited"
+	require.NoError(t, q.Retry(ctx, "1", &payload))
+	rec := getTestItem(t, q, "1")
+	assert.Equal(t, StatusPending, rec.Status)
+	assert.Equal(t, "edited", rec.Payload)
+
+	_, err = q.CancelAll(ctx, Filter{})
+	assert.Error(t, err)
+
+	n, err := q.CancelAll(ctx, Filter{GroupID: "g1"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = q.RetryAll(ctx, Filter{GroupID: "g1", Status: StatusCancelled})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// completed items are retried only when asked for explicitly.
+	_, err = q.db.Exec(`UPDATE queue SET status='DONE' WHERE id='1'`)
+	require.NoError(t, err)
+	require.NoError(t, q.Cancel(ctx, "2"))
+	n, err = q.RetryAll(ctx, Filter{GroupID: "g1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, StatusDone, getTestItem(t, q, "1").Status)
+
+	n, err = q.RetryAll(ctx, Filter{GroupID: "g1", Status: StatusDone})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.NoError(t, q.Delete(ctx, "3"))
+	assert.ErrorIs(t, q.Delete(ctx, "3"), ErrNotFound)
+
+	n, err = q.DeleteAll(ctx, Filter{Type: "test"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestSQLQueue_List(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, HandlerFn(nil))
+	pushTestItems(t, q,
+		Item{ID: "a_1", Type: "test", GroupID: "g1"},
+		Item{ID: "a_2", Type: "test", GroupID: "g1"},
+		Item{ID: "a_3", Type: "test", GroupID: "g2"},
+		Item{ID: "ab1", Type: "test", GroupID: "g2"},
+		Item{ID: "b_1", Type: "test", GroupID: "g2"},
+	)
+	_, err := q.db.Exec(`UPDATE queue SET last_error='connection refused' WHERE id='a_3'`)
+	require.NoError(t, err)
+
+	listAll := func(query Query) []string {
+		var ids []string
+		for {
+			page, err := q.List(ctx, query)
+			require.NoError(t, err)
+			for _, item := range page.Items {
+				ids = append(ids, item.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			query.Cursor = page.NextCursor
+		}
+	}
+
+	assert.Equal(t, []string{"a_1", "a_2", "a_3", "ab1", "b_1"}, listAll(Query{Limit: 2}))
+	assert.Equal(t, []string{"b_1", "ab1", "a_3", "a_2", "a_1"}, listAll(Query{Limit: 2, Desc: true}))
+	assert.Equal(t, []string{"a_1", "a_2", "a_3"}, listAll(Query{Limit: 1, IDPrefix: "a_", SortBy: SortID}))
+	assert.Equal(t, []string{"a_3", "ab1", "b_1"}, listAll(Query{Filter: Filter{GroupID: "g2"}}))
+	assert.Equal(t, []string{"a_3"}, listAll(Query{ErrorContains: "refused"}))
+	assert.Empty(t, listAll(Query{CreatedAfter: time.Now().Add(time.Minute)}))
+
+	_, err = q.List(ctx, Query{Cursor: "garbage!"})
+	assert.Error(t, err)
+}
+
+func TestSQLQueue_Search(t *testing.T) {
+	u := &url.URL{Scheme: "sqlite3", Host: filepath.Join(t.TempDir(), "genie.db")}
+	q, err := newSQLQueue(u, []string{"test"}, HandlerFn(nil), EnableSearch())
+	if err != nil && strings.Contains(err.Error(), "sqlite_fts5") {
+		t.Skip("fts5 not available, run tests with '-tags sqlite_fts5'")
+	}
+	require.NoError(t, err)
+	defer func() { _ = q.Close() }()
+
+	pushTestItems(t, q,
+		Item{ID: "1", Type: "test", Payload: `{"customer": "**acme** corp"}`},
+		Item{ID: "2", Type: "test", Payload: `{"customer": "globex"}`},
+	)
+	_, err = q.db.Exec(`UPDATE queue SET last_error='acme api timed out' WHERE id='2'`)
+	require.NoError(t, err)
+
+	hits, err := q.Search(context.Background(), "acme", 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 2)
+
+	hits, err = q.Search(context.Background(), `acme NOT "`, 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 0)
+
+	hits, err = q.Search(context.Background(), "acme timed", 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "2", hits[0].ID)
+	assert.Contains(t, hits[0].Snippet, "\x02acme\x03")
+
+	hits, err = q.Search(context.Background(), "corp", 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "{\"customer\": \"**acme** \x02corp\x03\"}", hits[0].Snippet)
+	assert.Equal(t, template.HTML(`{&#34;customer&#34;: &#34;**acme** <mark>corp</mark>&#34;}`), highlight(hits[0].Snippet))
+
+	require.NoError(t, q.Delete(context.Background(), "2"))
+	hits, err = q.Search(context.Background(), "timed", 10)
+	require.NoError(t, err)
+	assert.Len(t, hits, 0)
+
+	// the index does not depend on the implicit rowid, which VACUUM may
+	// renumber.
+	_, err = q.db.Exec(`UPDATE queue SET rowid = rowid + 100`)
+	require.NoError(t, err)
+	hits, err = q.Search(context.Background(), "corp", 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "1", hits[0].ID)
+
+	disabled := newTestQueue(t, HandlerFn(nil))
+	_, err = disabled.Search(context.Background(), "acme", 10)
+	assert.ErrorIs(t, err, ErrSearchDisabled)
+
+	// processes opening the queue without search keep the index up to date.
+	other, err := newSQLQueue(u, []string{"test"}, HandlerFn(nil))
+	require.NoError(t, err)
+	pushTestItems(t, other, Item{ID: "4", Type: "test", Payload: `{"customer": "umbrella"}`})
+	require.NoError(t, other.Close())
+	hits, err = q.Search(context.Background(), "umbrella", 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "4", hits[0].ID)
+
+	_, err = newSQLQueue(u, []string{"test"}, HandlerFn(nil), EnableSearch(), DropSearch())
+	assert.Error(t, err)
+
+	// dropping search removes the triggers and enabling it again reindexes
+	// the items written in the meantime.
+	require.NoError(t, q.Close())
+	q, err = newSQLQueue(u, []string{"test"}, HandlerFn(nil), DropSearch())
+	require.NoError(t, err)
+	var triggers int
+	require.NoError(t, q.db.Get(&triggers, `SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'queue_fts_%'`))
+	assert.Equal(t, 0, triggers)
+	pushTestItems(t, q, Item{ID: "3", Type: "test", Payload: `{"customer": "initech"}`})
+	require.NoError(t, q.Close())
+
+	q, err = newSQLQueue(u, []string{"test"}, HandlerFn(nil), EnableSearch())
+	require.NoError(t, err)
+	hits, err = q.Search(context.Background(), "initech", 10)
+	require.NoError(t, err)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "3", hits[0].ID)
+}
+
+func TestSQLQueue_Attempts(t *testing.T) {
+	ctx := context.Background()
+	fail := true
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		Logger(ctx).Printf("attempt %d", item.Attempt+1)
+		if fail {
+			Logger(ctx).Print(strings.Repeat("x", 100))
+			return nil, errors.New("flaky")
+		}
+		return []byte("ok"), nil
+	}), WorkerID("w1"), func(o *Options) {
+		o.MaxAttempts = 3
+		o.MaxLogSize = 64
+		o.RetryBackoff = 0
+	})
+	pushTestItems(t, q, Item{ID: "1", Type: "test"})
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+	fail = false
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+
+	attempts, err := q.Attempts(ctx, "1")
+	require.NoError(t, err)
+	require.Len(t, attempts, 2)
+	assert.Equal(t, 1, attempts[0].Number)
+	assert.Equal(t, StatusPending, attempts[0].Outcome)
+	assert.Equal(t, "flaky", attempts[0].Error)
+	assert.Equal(t, "w1", attempts[0].WorkerID)
+	assert.Contains(t, attempts[0].Log, "attempt 1")
+	assert.True(t, strings.HasSuffix(attempts[0].Log, "(truncated)"))
+	assert.Contains(t, attempts[1].Log, "attempt 2")
+	assert.NotContains(t, attempts[1].Log, "truncated")
+	assert.Equal(t, 2, attempts[1].Number)
+	assert.Equal(t, StatusDone, attempts[1].Outcome)
+	assert.Equal(t, 2, attempts[1].ResultSize)
+	assert.Empty(t, attempts[1].Error)
+
+	require.NoError(t, q.Delete(ctx, "1"))
+	attempts, err = q.Attempts(ctx, "1")
+	require.NoError(t, err)
+	assert.Empty(t, attempts)
+}
+
+func TestSQLQueue_ReportProgress(t *testing.T) {
+	ctx := context.Background()
+
+	var q *sqlQueue
+	q = newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		require.NoError(t, ReportProgress(ctx, 0.3, "step 1"))
+		require.NoError(t, ReportProgress(ctx, 0.5, "step 2"))
+
+		saved, err := q.Get(ctx, item.ID)
+		require.NoError(t, err)
+		assert.Equal(t, Progress{Fraction: 0.3, Message: "step 1"}, saved.Progress)
+		return nil, errors.New("retry later")
+	}), func(o *Options) {
+		o.MaxAttempts = 2
+		o.ProgressInterval = time.Hour
+	})
+	pushTestItems(t, q, Item{ID: "1", Type: "test"}, Item{ID: "2", Type: "test"})
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+
+	item, err := q.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, Progress{Fraction: 0.5, Message: "step 2"}, item.Progress)
+
+	stats, err := q.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.InDelta(t, 0.25, stats[0].Progress, 0.001)
+
+	assert.NoError(t, ReportProgress(ctx, 1, "outside handler"))
+}
+
+func TestSQLQueue_Cancel_running(t *testing.T) {
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	var q *sqlQueue
+	q = newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}), func(o *Options) {
+		o.MaxAttempts = 3
+		o.FnTimeout = 10 * time.Second
+		o.LeaseTimeout = 30 * time.Millisecond
+	})
+	pushTestItems(t, q, Item{ID: "1", Type: "test"})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- q.processRecord(ctx, getTestItem(t, q, "1"), q.handle) }()
+
+	<-started
+	assert.Equal(t, StatusRunning, getTestItem(t, q, "1").Status)
+	require.NoError(t, q.Cancel(ctx, "1"))
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+
+	rec := getTestItem(t, q, "1")
+	assert.Equal(t, StatusCancelled, rec.Status)
+	assert.Equal(t, 0, rec.Attempts)
+	assert.False(t, rec.LeaseOwner.Valid)
+
+	attempts, err := q.Attempts(ctx, "1")
+	require.NoError(t, err)
+	require.Len(t, attempts, 1)
+	assert.Equal(t, StatusCancelled, attempts[0].Outcome)
+}
+
+func TestSQLQueue_claim_expiredLease(t *testing.T) {
+	ctx := context.Background()
+
+	calls := 0
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		calls++
+		return []byte("ok"), nil
+	}), func(o *Options) { o.MaxAttempts = 2 })
+	crash := func(id string) {
+		_, err := q.db.Exec(`UPDATE queue SET status='RUNNING', lease_owner='crashed', lease_expires_at=? WHERE id=?`,
+			time.Now().Add(-time.Minute).UTC(), id)
+		require.NoError(t, err)
+	}
+
+	pushTestItems(t, q, Item{ID: "1", Type: "test", MaxAttempts: 1}, Item{ID: "2", Type: "test"})
+
+	stale := getTestItem(t, q, "2")
+	crash("1")
+	crash("2")
+
+	batch, err := q.getBatch(ctx, []string{"test"})
+	require.NoError(t, err)
+	require.Len(t, batch, 2)
+	fetched := map[string]sqlQueueItem{}
+	for _, rec := range batch {
+		fetched[rec.ID] = rec
+	}
+
+	// the lost attempt counts against max attempts.
+	require.NoError(t, q.processRecord(ctx, fetched["1"], q.handle))
+	rec := getTestItem(t, q, "1")
+	assert.Equal(t, StatusFailed, rec.Status)
+	assert.Equal(t, 1, rec.Attempts)
+	assert.Equal(t, "lease of worker 'crashed' expired", rec.LastError.String)
+	assert.Equal(t, 0, calls)
+
+	// a stale snapshot cannot claim the item without reclaiming it.
+	require.NoError(t, q.processRecord(ctx, stale, q.handle))
+	assert.Equal(t, StatusRunning, getTestItem(t, q, "2").Status)
+
+	require.NoError(t, q.processRecord(ctx, fetched["2"], q.handle))
+	rec = getTestItem(t, q, "2")
+	assert.Equal(t, StatusDone, rec.Status)
+	assert.Equal(t, 2, rec.Attempts)
+	assert.Equal(t, 1, calls)
+
+	attempts, err := q.Attempts(ctx, "2")
+	require.NoError(t, err)
+	require.Len(t, attempts, 2)
+	assert.Equal(t, "crashed", attempts[0].WorkerID)
+	assert.Equal(t, StatusPending, attempts[0].Outcome)
+	assert.Equal(t, StatusDone, attempts[1].Outcome)
+
+	// claimed items must not be picked up by other workers.
+	pushTestItems(t, q, Item{ID: "3", Type: "test"})
+	rec = getTestItem(t, q, "3")
+	claimed, err := q.claim(ctx, &rec)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	claimed, err = q.claim(ctx, &rec)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+}
+
+func TestSQLQueue_Open_invalidOptions(t *testing.T) {
+	u := &url.URL{Scheme: "sqlite3", Host: filepath.Join(t.TempDir(), "genie.db")}
+	for _, opt := range []Option{LeaseTimeout(0), KeyConcurrency(0)} {
+		_, err := newSQLQueue(u, []string{"test"}, HandlerFn(nil), opt)
+		assert.Error(t, err)
+	}
+}
+
+func TestSQLQueue_claim_staleBatch(t *testing.T) {
+	ctx := context.Background()
+
+	var payloads []string
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		payloads = append(payloads, item.Payload)
+		return nil, errors.New("retry")
+	}), func(o *Options) { o.MaxAttempts = 3 })
+	pushTestItems(t, q, Item{ID: "1", Type: "test", Payload: "v1"})
+	stale := getTestItem(t, q, "1")
+
+	// another worker executes the item and re-queues it with backoff.
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+	require.NoError(t, q.processRecord(ctx, stale, q.handle))
+	assert.Equal(t, []string{"v1"}, payloads)
+	assert.Equal(t, 1, getTestItem(t, q, "1").Attempts)
+
+	// once due, the stored item is executed rather than the stale one.
+	_, err := q.db.Exec(`UPDATE queue SET payload='v2', next_attempt_at=? WHERE id='1'`, time.Now().UTC())
+	require.NoError(t, err)
+	require.NoError(t, q.processRecord(ctx, stale, q.handle))
+	assert.Equal(t, []string{"v1", "v2"}, payloads)
+	assert.Equal(t, 2, getTestItem(t, q, "1").Attempts)
+}
+
+func TestSQLQueue_Checkpoint(t *testing.T) {
+	ctx := context.Background()
+
+	var seen []string
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		seen = append(seen, string(item.Checkpoint))
+		if item.Checkpoint == nil {
+			require.NoError(t, Checkpoint(ctx, []byte("step-1")))
+			return nil, errors.New("crashed after step 1")
+		}
+		return []byte("resumed"), nil
+	}), func(o *Options) {
+		o.MaxAttempts = 2
+		o.RetryBackoff = 0
+	})
+	pushTestItems(t, q, Item{ID: "1", Type: "test"})
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+	item, err := q.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("step-1"), item.Checkpoint)
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+	assert.Equal(t, []string{"", "step-1"}, seen)
+	assert.Equal(t, StatusDone, getTestItem(t, q, "1").Status)
+
+	// a new payload invalidates the saved state.
+	payload := "v2"
+	require.NoError(t, q.Retry(ctx, "1", &payload))
+	assert.Nil(t, getTestItem(t, q, "1").Checkpoint)
+
+	assert.NoError(t, Checkpoint(ctx, []byte("outside handler")))
+}
+
+func TestSQLQueue_dependencies(t *testing.T) {
+	ctx := context.Background()
+	handler := HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		if item.Payload == "fail" {
+			return nil, ErrFail
+		}
+		return nil, nil
+	})
+
+	t.Run("UnblockWhenParentsDone", func(t *testing.T) {
+		q := newTestQueue(t, handler)
+		pushTestItems(t, q,
+			Item{ID: "b", Type: "test", GroupID: "g", DependsOn: []string{"a", "c"}},
+			Item{ID: "a", Type: "test", GroupID: "g"},
+			Item{ID: "c", Type: "test", GroupID: "g"},
+		)
+		assert.Equal(t, StatusBlocked, getTestItem(t, q, "b").Status)
+
+		require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "a"), q.handle))
+		assert.Equal(t, StatusBlocked, getTestItem(t, q, "b").Status)
+
+		require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "c"), q.handle))
+		assert.Equal(t, StatusPending, getTestItem(t, q, "b").Status)
+
+		item, err := q.Get(ctx, "b")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "c"}, item.DependsOn)
+
+		deps, err := q.Dependencies(ctx, "g")
+		require.NoError(t, err)
+		assert.Equal(t, []Dependency{{ItemID: "b", ParentID: "a"}, {ItemID: "b", ParentID: "c"}}, deps)
+
+		// dependents pushed after the parents finished are not blocked.
+		pushTestItems(t, q, Item{ID: "d", Type: "test", DependsOn: []string{"a"}})
+		assert.Equal(t, StatusPending, getTestItem(t, q, "d").Status)
+	})
+
+	t.Run("Cascade", func(t *testing.T) {
+		for policy, want := range map[DependencyPolicy]string{DependencyFail: StatusFailed, DependencySkip: StatusSkipped} {
+			q := newTestQueue(t, handler, OnDependencyFailure(policy))
+			pushTestItems(t, q,
+				Item{ID: "a", Type: "test", Payload: "fail"},
+				Item{ID: "b", Type: "test", DependsOn: []string{"a"}},
+				Item{ID: "c", Type: "test", DependsOn: []string{"b"}},
+				Item{ID: "d", Type: "test", DependsOn: []string{"missing"}},
+			)
+
+			d := getTestItem(t, q, "d")
+			assert.Equal(t, want, d.Status)
+			assert.Equal(t, "dependency 'missing' is missing", d.LastError.String)
+
+			require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "a"), q.handle))
+			b, c := getTestItem(t, q, "b"), getTestItem(t, q, "c")
+			assert.Equal(t, want, b.Status)
+			assert.Equal(t, "dependency 'a' is FAILED", b.LastError.String)
+			assert.Equal(t, want, c.Status)
+			assert.Equal(t, "dependency 'b' is "+want, c.LastError.String)
+			assert.Equal(t, 0, c.Attempts)
+
+			// retried dependents wait for their parents again.
+			require.NoError(t, q.Retry(ctx, "c", nil))
+			assert.Equal(t, want, getTestItem(t, q, "c").Status)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		q := newTestQueue(t, handler)
+		pushTestItems(t, q,
+			Item{ID: "a", Type: "test"},
+			Item{ID: "b", Type: "test", DependsOn: []string{"a"}},
+		)
+		_, err := q.db.Exec(`UPDATE queue SET updated_at=?`, time.Now().Add(-time.Hour).UTC())
+		require.NoError(t, err)
+
+		// dependents of deleted parents are resolved even if they had no
+		// updates in the meantime.
+		require.NoError(t, q.Delete(ctx, "a"))
+		b := getTestItem(t, q, "b")
+		assert.Equal(t, StatusFailed, b.Status)
+		assert.Equal(t, "dependency 'a' is missing", b.LastError.String)
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		q := newTestQueue(t, handler)
+		pushTestItems(t, q, Item{ID: "a", Type: "test"})
+		pushTestItems(t, q, Item{ID: "b", Type: "test", DependsOn: []string{"a"}})
+
+		results, err := q.Push(ctx, PushOptions{BestEffort: true, OnConflict: ConflictReplace},
+			Item{ID: "a", Type: "test", DependsOn: []string{"b"}},
+			Item{ID: "c", Type: "test", DependsOn: []string{"c"}},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, PushInvalid, results[0].Status)
+		assert.Equal(t, "dependency on 'b' creates a cycle", results[0].Reason)
+		assert.Equal(t, PushInvalid, results[1].Status)
+	})
+}
+
+func TestSQLQueue_Spawn(t *testing.T) {
+	ctx := context.Background()
+
+	var fanIn []ChildOutcome
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		switch {
+		case item.Payload == "crawl" && item.Children == nil:
+			require.NoError(t, Spawn(ctx, Item{Type: "test", Payload: "page-1"}, Item{Type: "test", Payload: "fail"}))
+			return nil, nil
+
+		case item.Payload == "crawl":
+			fanIn = item.Children
+			return []byte("crawled"), nil
+
+		case item.Payload == "fail":
+			return nil, ErrFail
+
+		default:
+			return []byte(item.Payload), nil
+		}
+	}))
+	pushTestItems(t, q, Item{ID: "site", Type: "test", GroupID: "g", Payload: "crawl"})
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "site"), q.handle))
+	assert.Equal(t, StatusWaiting, getTestItem(t, q, "site").Status)
+
+	child := getTestItem(t, q, "site.1")
+	assert.Equal(t, "g", child.GroupID)
+	assert.Equal(t, "site", child.ParentID.String)
+
+	require.NoError(t, q.processRecord(ctx, child, q.handle))
+	assert.Equal(t, StatusWaiting, getTestItem(t, q, "site").Status)
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "site.2"), q.handle))
+	assert.Equal(t, StatusPending, getTestItem(t, q, "site").Status)
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "site"), q.handle))
+	parent := getTestItem(t, q, "site")
+	assert.Equal(t, StatusDone, parent.Status)
+	assert.Equal(t, "crawled", parent.Result.String)
+	assert.Equal(t, []ChildOutcome{
+		{ID: "site.1", Type: "test", Status: StatusDone, Result: "page-1"},
+		{ID: "site.2", Type: "test", Status: StatusFailed, LastError: ErrFail.Error()},
+	}, fanIn)
+
+	assert.Error(t, Spawn(ctx, Item{Type: "test"}))
+}
+
+func TestSQLQueue_Spawn_waiting(t *testing.T) {
+	ctx := context.Background()
+
+	resumed := 0
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		switch {
+		case item.Payload == "parent" && item.Children == nil:
+			if item.ID == "p1" {
+				return nil, Spawn(ctx, Item{Type: "test", Payload: "leaf"})
+			}
+			return nil, Spawn(ctx, Item{Type: "test", Payload: "child"})
+
+		case item.Payload == "parent":
+			if resumed++; resumed == 1 {
+				return nil, errors.New("flaky")
+			}
+			return []byte("resumed"), nil
+
+		case item.Payload == "child":
+			return nil, Spawn(ctx, Item{Type: "test", Payload: "leaf"})
+
+		default:
+			return nil, nil
+		}
+	}), func(o *Options) {
+		o.MaxAttempts = 2
+		o.RetryBackoff = 0
+	})
+	pushTestItems(t, q, Item{ID: "p1", Type: "test", Payload: "parent"}, Item{ID: "p2", Type: "test", Payload: "parent"})
+
+	// resuming does not count the attempt that spawned the children.
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "p1"), q.handle))
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "p1.1"), q.handle))
+	assert.Equal(t, 0, getTestItem(t, q, "p1").Attempts)
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "p1"), q.handle))
+	assert.Equal(t, StatusPending, getTestItem(t, q, "p1").Status)
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "p1"), q.handle))
+	assert.Equal(t, StatusDone, getTestItem(t, q, "p1").Status)
+
+	// cancelling a waiting item cancels its descendants.
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "p2"), q.handle))
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "p2.1"), q.handle))
+	assert.Equal(t, StatusWaiting, getTestItem(t, q, "p2.1").Status)
+
+	require.NoError(t, q.Cancel(ctx, "p2"))
+	for _, id := range []string{"p2", "p2.1", "p2.1.1"} {
+		assert.Equal(t, StatusCancelled, getTestItem(t, q, id).Status, id)
+	}
+
+	item, err := q.Get(ctx, "p2")
+	require.NoError(t, err)
+	assert.Len(t, item.Children, 1)
+}
+
+func TestSQLQueue_finalizers(t *testing.T) {
+	ctx := context.Background()
+
+	type call struct {
+		stats   Stats
+		results []string
+	}
+	calls := make(chan call, 10)
+	finalizer := func(ctx context.Context, stats Stats, q Queue) error {
+		c := call{stats: stats}
+		err := q.ForEach(ctx, stats.GroupID, StatusDone, func(ctx context.Context, item Item) error {
+			c.results = append(c.results, item.Result)
+			return nil
+		})
+		calls <- c
+		return err
+	}
+
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		if item.Payload == "fail" {
+			return nil, ErrFail
+		}
+		return []byte("result-" + item.ID), nil
+	}), FinalizeType("test", finalizer))
+	pushTestItems(t, q,
+		Item{ID: "1", Type: "test", GroupID: "g"},
+		Item{ID: "2", Type: "test", GroupID: "g", Payload: "fail"},
+	)
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+	require.NoError(t, q.finalizeGroups(ctx))
+	assert.Len(t, calls, 0, "group is not finished yet")
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "2"), q.handle))
+	require.NoError(t, q.finalizeGroups(ctx))
+	require.Len(t, calls, 1)
+
+	c := <-calls
+	assert.Equal(t, "g", c.stats.GroupID)
+	assert.Equal(t, "test", c.stats.Type)
+	assert.Equal(t, 2, c.stats.Total)
+	assert.Equal(t, 1, c.stats.Failed)
+	assert.Equal(t, []string{"result-1"}, c.results)
+
+	// other instances with the same finalizer do not fire it again.
+	other, err := newSQLQueue(&url.URL{Scheme: "sqlite3", Host: q.file}, []string{"test"}, q.handle,
+		FinalizeType("test", finalizer), FinalizeGroup("g", finalizer))
+	require.NoError(t, err)
+	defer other.Close()
+
+	require.NoError(t, q.finalizeGroups(ctx))
+	require.NoError(t, other.finalizeGroups(ctx))
+	require.Len(t, calls, 1, "only the group finalizer must fire")
+	assert.Equal(t, "g", (<-calls).stats.GroupID)
+
+	require.NoError(t, other.finalizeGroups(ctx))
+	assert.Len(t, calls, 0)
+
+	// the empty group is never finalized.
+	pushTestItems(t, q, Item{ID: "3", Type: "test"})
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "3"), q.handle))
+	require.NoError(t, q.finalizeGroups(ctx))
+	assert.Len(t, calls, 0)
+
+	// deleting the last unfinished item finishes the group even if it had
+	// no updates since the last sweep.
+	pushTestItems(t, q, Item{ID: "4", Type: "test", GroupID: "h"}, Item{ID: "5", Type: "test", GroupID: "h"})
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "4"), q.handle))
+	_, err = q.db.Exec(`UPDATE queue SET updated_at=? WHERE group_id='h'`, time.Now().Add(-time.Hour).UTC())
+	require.NoError(t, err)
+	require.NoError(t, q.finalizeGroups(ctx))
+	assert.Len(t, calls, 0)
+
+	require.NoError(t, q.Delete(ctx, "5"))
+	require.NoError(t, q.finalizeGroups(ctx))
+	require.Len(t, calls, 1)
+	assert.Equal(t, 1, (<-calls).stats.Done)
+}
+
+func TestSQLQueue_finalizers_timeout(t *testing.T) {
+	ctx := context.Background()
+
+	hung := func(ctx context.Context, stats Stats, q Queue) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil }),
+		FinalizeType("test", hung), func(o *Options) { o.FnTimeout = 50 * time.Millisecond })
+	pushTestItems(t, q, Item{ID: "1", Type: "test", GroupID: "g"})
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+
+	// a hung finalizer does not hold up the worker beyond the timeout.
+	start := time.Now()
+	require.NoError(t, q.finalizeGroups(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+
+	var f struct {
+		Status string         `db:"status"`
+		Error  sql.NullString `db:"error"`
+	}
+	require.NoError(t, q.db.Get(&f, `SELECT status, error FROM finalizations WHERE group_id='g'`))
+	assert.Equal(t, StatusFailed, f.Status)
+	assert.Contains(t, f.Error.String, "deadline exceeded")
+}
+
+func TestSQLQueue_schedules(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil }))
+
+	_, err := q.PutSchedule(ctx, Schedule{ID: "bad", Cron: "* * *", Type: "test"})
+	assert.Error(t, err)
+
+	for _, policy := range []MissedRunPolicy{MissedRunSkip, MissedRunCatchUp} {
+		s, err := q.PutSchedule(ctx, Schedule{
+			ID:         string(policy),
+			Cron:       "* * * * *",
+			Timezone:   "Asia/Kolkata",
+			Type:       "test",
+			Payload:    `{"at": "{{.Time.Format "15:04"}}"}`,
+			GroupID:    `{{.ScheduleID}}-{{.Time.Format "2006-01-02"}}`,
+			MissedRuns: policy,
+		})
+		require.NoError(t, err)
+		assert.True(t, s.NextRunAt.After(time.Now()))
+	}
+
+	// pretend the schedules were missed for a few minutes. runs are per
+	// minute, so avoid crossing into the next minute while firing.
+	if time.Now().Second() >= 55 {
+		time.Sleep(6 * time.Second)
+	}
+	missedFrom := time.Now().UTC().Truncate(time.Minute).Add(-3 * time.Minute)
+	_, err = q.db.Exec(`UPDATE schedules SET next_run_at=?`, missedFrom)
+	require.NoError(t, err)
+
+	due, err := q.Schedules(ctx)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+
+	require.NoError(t, q.fireSchedules(ctx))
+
+	// firing again from a stale read must not enqueue the runs again.
+	var stale sqlSchedule
+	require.NoError(t, q.db.Get(&stale, `SELECT * FROM schedules WHERE id='catch_up'`))
+	stale.NextRunAt = missedFrom
+	require.NoError(t, q.fireSchedule(ctx, stale))
+	require.NoError(t, q.fireSchedules(ctx))
+
+	countItems := func(groupPrefix string) int {
+		var n int
+		require.NoError(t, q.db.Get(&n, `SELECT count(*) FROM queue WHERE group_id LIKE ?`, groupPrefix+"%"))
+		return n
+	}
+	assert.Equal(t, 1, countItems("skip-"))
+	assert.Equal(t, 4, countItems("catch_up-"))
+
+	ist, _ := time.LoadLocation("Asia/Kolkata")
+	id := fmt.Sprintf("skip@%d", missedFrom.Add(3*time.Minute).Unix())
+	item, err := q.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "skip-"+missedFrom.In(ist).Format("2006-01-02"), item.GroupID)
+	assert.Equal(t, `{"at": "`+missedFrom.Add(3*time.Minute).In(ist).Format("15:04")+`"}`, item.Payload)
+
+	schedules, err := q.Schedules(ctx)
+	require.NoError(t, err)
+	for _, s := range schedules {
+		assert.True(t, s.NextRunAt.After(time.Now()))
+		assert.Equal(t, missedFrom.Add(3*time.Minute).Unix(), s.LastRunAt.Unix())
+	}
+
+	require.NoError(t, q.DeleteSchedule(ctx, "skip"))
+	assert.ErrorIs(t, q.DeleteSchedule(ctx, "skip"), ErrNotFound)
+}
+
+func TestSQLQueue_deadlines(t *testing.T) {
+	ctx := context.Background()
+
+	var invoked []string
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		invoked = append(invoked, item.ID)
+		return nil, errors.New("try again")
+	}), func(o *Options) {
+		o.MaxAttempts = 3
+		o.RetryBackoff = time.Minute
+	})
+
+	now := time.Now()
+	pushTestItems(t, q,
+		Item{ID: "passed", Type: "test", GroupID: "g", Deadline: now.Add(-time.Second)},
+		Item{ID: "soon", Type: "test", GroupID: "g", Deadline: now.Add(30 * time.Second)},
+		Item{ID: "later", Type: "test", GroupID: "g", Deadline: now.Add(time.Hour)},
+		Item{ID: "dependent", Type: "test", GroupID: "g", DependsOn: []string{"passed"}},
+	)
+
+	for _, id := range []string{"passed", "soon", "later"} {
+		require.NoError(t, q.processRecord(ctx, getTestItem(t, q, id), q.handle))
+	}
+	assert.Equal(t, []string{"soon", "later"}, invoked)
+
+	passed, err := q.Get(ctx, "passed")
+	require.NoError(t, err)
+	assert.Equal(t, StatusExpired, passed.Status)
+	assert.Contains(t, passed.LastError, "deadline")
+	assert.Equal(t, 0, passed.Attempt)
+	assert.WithinDuration(t, now.Add(-time.Second), passed.Deadline, time.Millisecond)
+
+	// retry would land past the deadline.
+	soon := getTestItem(t, q, "soon")
+	assert.Equal(t, StatusExpired, soon.Status)
+	assert.Equal(t, "try again", soon.LastError.String)
+	assert.Equal(t, StatusPending, getTestItem(t, q, "later").Status)
+	assert.Equal(t, StatusFailed, getTestItem(t, q, "dependent").Status)
+
+	stats, err := q.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, 2, stats[0].Expired)
+	assert.Equal(t, 1, stats[0].Pending)
+}
+
+func TestSQLQueue_expireOverdue(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil }))
+
+	now := time.Now()
+	pushTestItems(t, q,
+		Item{ID: "paused", Type: "test", GroupID: "g", Deadline: now.Add(50 * time.Millisecond)},
+		Item{ID: "blocked", Type: "test", GroupID: "g", Deadline: now.Add(50 * time.Millisecond), DependsOn: []string{"paused"}},
+		Item{ID: "dependent", Type: "test", GroupID: "g", DependsOn: []string{"blocked"}},
+		Item{ID: "later", Type: "test", GroupID: "g", Deadline: now.Add(time.Hour)},
+	)
+	require.NoError(t, q.Pause(ctx, Pause{Type: "test"}))
+
+	require.NoError(t, q.expireOverdue(ctx))
+	assert.Equal(t, StatusPending, getTestItem(t, q, "paused").Status)
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, q.expireOverdue(ctx))
+	assert.Equal(t, StatusExpired, getTestItem(t, q, "paused").Status)
+	assert.Equal(t, StatusExpired, getTestItem(t, q, "blocked").Status)
+	assert.Equal(t, StatusFailed, getTestItem(t, q, "dependent").Status)
+	assert.Equal(t, StatusPending, getTestItem(t, q, "later").Status)
+
+	stats, err := q.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, 2, stats[0].Expired)
+}
+
+func TestSQLQueue_rateLimits(t *testing.T) {
+	ctx := context.Background()
+
+	var invoked []string
+	handler := HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		invoked = append(invoked, item.ID)
+		return nil, nil
+	})
+	processBatch := func(q *sqlQueue) {
+		batch, err := q.getBatch(ctx, q.types)
+		require.NoError(t, err)
+		for _, rec := range batch {
+			require.NoError(t, q.processRecord(ctx, rec, q.handle))
+		}
+	}
+
+	t.Run("SharedAcrossProcesses", func(t *testing.T) {
+		invoked = nil
+		limit := RateLimitType("test", time.Hour, 2)
+		q1 := newTestQueue(t, handler, limit)
+		q2, err := newSQLQueue(&url.URL{Scheme: "sqlite3", Host: q1.file}, q1.types, handler, limit)
+		require.NoError(t, err)
+		defer q2.Close()
+
+		pushTestItems(t, q1,
+			Item{ID: "1", Type: "test"}, Item{ID: "2", Type: "test"},
+			Item{ID: "3", Type: "test"}, Item{ID: "4", Type: "test"},
+		)
+		processBatch(q1)
+		processBatch(q2)
+		assert.Len(t, invoked, 2)
+
+		batch, err := q2.getBatch(ctx, q2.types)
+		require.NoError(t, err)
+		assert.Empty(t, batch, "exhausted type must not be fetched")
+	})
+
+	t.Run("PerGroup", func(t *testing.T) {
+		invoked = nil
+		q := newTestQueue(t, handler, RateLimitGroup("slow", time.Hour, 1), RateLimitGroup("fast", 50*time.Millisecond, 1))
+		pushTestItems(t, q,
+			Item{ID: "slow-1", Type: "test", GroupID: "slow"}, Item{ID: "slow-2", Type: "test", GroupID: "slow"},
+			Item{ID: "fast-1", Type: "test", GroupID: "fast"}, Item{ID: "fast-2", Type: "test", GroupID: "fast"},
+			Item{ID: "other", Type: "test", GroupID: "other"},
+		)
+		processBatch(q)
+		assert.ElementsMatch(t, []string{"slow-1", "fast-1", "other"}, invoked)
+
+		time.Sleep(100 * time.Millisecond)
+		processBatch(q)
+		assert.ElementsMatch(t, []string{"slow-1", "fast-1", "other", "fast-2"}, invoked)
+		assert.Equal(t, StatusPending, getTestItem(t, q, "slow-2").Status)
+	})
+}
+
+func TestSQLQueue_concurrencyKeys(t *testing.T) {
+	ctx := context.Background()
+	noop := HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil })
+
+	t.Run("Claim", func(t *testing.T) {
+		q := newTestQueue(t, noop, KeyConcurrency(2))
+		pushTestItems(t, q,
+			Item{ID: "1", Type: "test", ConcurrencyKey: "k"},
+			Item{ID: "2", Type: "test", ConcurrencyKey: "k"},
+			Item{ID: "3", Type: "test", ConcurrencyKey: "k"},
+			Item{ID: "4", Type: "test"},
+		)
+
+		for _, id := range []string{"1", "2"} {
+			rec := getTestItem(t, q, id)
+			claimed, err := q.claim(ctx, &rec)
+			require.NoError(t, err)
+			require.True(t, claimed)
+		}
+
+		rec := getTestItem(t, q, "3")
+		claimed, err := q.claim(ctx, &rec)
+		require.NoError(t, err)
+		assert.False(t, claimed, "key is saturated")
+
+		batch, err := q.getBatch(ctx, q.types)
+		require.NoError(t, err)
+		require.Len(t, batch, 1)
+		assert.Equal(t, "4", batch[0].ID)
+
+		item, err := q.Get(ctx, "3")
+		require.NoError(t, err)
+		assert.Equal(t, "k", item.ConcurrencyKey)
+
+		// running items with expired leases do not count.
+		_, err = q.db.Exec(`UPDATE queue SET lease_expires_at=? WHERE id='1'`, time.Now().Add(-time.Second).UTC())
+		require.NoError(t, err)
+		claimed, err = q.claim(ctx, &rec)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+	})
+
+	t.Run("WorkerPool", func(t *testing.T) {
+		var mu sync.Mutex
+		running, maxRunning := map[string]int{}, map[string]int{}
+		handler := HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+			mu.Lock()
+			running[item.ConcurrencyKey]++
+			if running[item.ConcurrencyKey] > maxRunning[item.ConcurrencyKey] {
+				maxRunning[item.ConcurrencyKey] = running[item.ConcurrencyKey]
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running[item.ConcurrencyKey]--
+			mu.Unlock()
+			return nil, nil
+		})
+
+		q1 := newTestQueue(t, handler)
+		q2, err := newSQLQueue(&url.URL{Scheme: "sqlite3", Host: q1.file}, q1.types, handler,
+			func(o *Options) { o.PollInt = 10 * time.Millisecond })
+		require.NoError(t, err)
+		defer q2.Close()
+
+		var items []Item
+		for i := 0; i < 6; i++ {
+			items = append(items,
+				Item{ID: fmt.Sprintf("a-%d", i), Type: "test", ConcurrencyKey: "a"},
+				Item{ID: fmt.Sprintf("b-%d", i), Type: "test", ConcurrencyKey: "b"},
+				Item{ID: fmt.Sprintf("n-%d", i), Type: "test"},
+			)
+		}
+		pushTestItems(t, q1, items...)
+
+		runCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		for _, q := range []*sqlQueue{q1, q1, q2, q2} {
+			wg.Add(1)
+			go func(q *sqlQueue) {
+				defer wg.Done()
+				_ = q.Run(runCtx)
+			}(q)
+		}
+
+		require.Eventually(t, func() bool {
+			stats, err := q1.Stats()
+			return err == nil && len(stats) == 1 && stats[0].Done == len(items)
+		}, 10*time.Second, 10*time.Millisecond)
+		cancel()
+		wg.Wait()
+
+		assert.Equal(t, 1, maxRunning["a"])
+		assert.Equal(t, 1, maxRunning["b"])
+	})
+}
+
+func TestSQLQueue_coalesce(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil }),
+		CoalesceType("merged", func(ctx context.Context, pending, item Item) (Item, error) {
+			if item.Payload == "bad" {
+				return item, errors.New("cannot merge")
+			}
+			item.Payload = pending.Payload + "," + item.Payload
+			item.ConcurrencyKey = "merged"
+			return item, nil
+		}))
+	opts := PushOptions{Debounce: time.Minute}
+
+	push := func(items ...Item) []PushResult {
+		results, err := q.Push(ctx, opts, items...)
+		require.NoError(t, err)
+		return results
+	}
+
+	start := time.Now()
+	results := push(
+		Item{ID: "1", Type: "test", Payload: "v1", CoalesceKey: "x"},
+		Item{ID: "2", Type: "test", Payload: "v2", CoalesceKey: "x"},
+		Item{ID: "3", Type: "test", Payload: "other", CoalesceKey: "y"},
+	)
+	assert.Equal(t, PushAccepted, results[0].Status)
+	assert.Equal(t, PushCoalesced, results[1].Status)
+	assert.Equal(t, "coalesced into '1'", results[1].Reason)
+	assert.Equal(t, PushAccepted, results[2].Status)
+
+	first := getTestItem(t, q, "1")
+	assert.Equal(t, "v2", first.Payload)
+	assert.WithinDuration(t, start.Add(time.Minute), first.NextAttemptAt, time.Second)
+
+	// start is pushed back by every push.
+	time.Sleep(10 * time.Millisecond)
+	push(Item{ID: "4", Type: "test", Payload: "v4", CoalesceKey: "x"})
+	assert.Equal(t, "v4", getTestItem(t, q, "1").Payload)
+	assert.True(t, getTestItem(t, q, "1").NextAttemptAt.After(first.NextAttemptAt))
+
+	// only pending items are coalesced into.
+	_, err := q.db.Exec(`UPDATE queue SET status='RUNNING' WHERE id='1'`)
+	require.NoError(t, err)
+	results = push(Item{ID: "5", Type: "test", Payload: "v5", CoalesceKey: "x"})
+	assert.Equal(t, PushAccepted, results[0].Status)
+
+	// coalescer merges payloads and can reject items.
+	push(Item{ID: "m1", Type: "merged", Payload: "a", CoalesceKey: "x"})
+	push(Item{ID: "m2", Type: "merged", Payload: "b", CoalesceKey: "x"})
+	assert.Equal(t, "a,b", getTestItem(t, q, "m1").Payload)
+	assert.Equal(t, "merged", getTestItem(t, q, "m1").ConcurrencyKey.String)
+
+	results, err = q.Push(ctx, opts, Item{ID: "m3", Type: "merged", Payload: "bad", CoalesceKey: "x"})
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, PushInvalid, results[0].Status)
+
+	results, err = q.Push(ctx, opts, Item{ID: "d", Type: "test", CoalesceKey: "z", DependsOn: []string{"3"}})
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, PushInvalid, results[0].Status)
+
+	// duplicates are ignored before coalescing.
+	dedupe := PushOptions{DedupeWindow: time.Minute}
+	results, err = q.Push(ctx, dedupe, Item{ID: "6", Type: "test", Payload: "other", CoalesceKey: "y"})
+	require.NoError(t, err)
+	assert.Equal(t, PushIgnored, results[0].Status)
+
+	// children are only coalesced with children of the same parent.
+	pushChild := func(id, parentID string) string {
+		var status string
+		_, err := q.withTx(ctx, time.Now().UTC(), func(tx *sqlx.Tx) (n int, err error) {
+			item := Item{ID: id, Type: "test", Payload: id, CoalesceKey: "y"}
+			status, _, err = q.pushItem(ctx, tx, opts, item, parentID, time.Now().UTC())
+			return 0, err
+		})
+		require.NoError(t, err)
+		return status
+	}
+	assert.Equal(t, PushAccepted, pushChild("c1", "p"))
+	assert.Equal(t, PushCoalesced, pushChild("c2", "p"))
+	assert.Equal(t, PushAccepted, pushChild("c3", "other"))
+	assert.Equal(t, "c2", getTestItem(t, q, "c1").Payload)
+	assert.Equal(t, "other", getTestItem(t, q, "3").Payload)
+}
+
+func TestSQLQueue_pauses(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) { return nil, nil }))
+	q.types = []string{"test", "other"}
+	pushTestItems(t, q,
+		Item{ID: "1", Type: "test", GroupID: "g1"},
+		Item{ID: "2", Type: "test", GroupID: "g2"},
+		Item{ID: "3", Type: "other", GroupID: "g1"},
+	)
+	batchIDs := func() []string {
+		batch, err := q.getBatch(ctx, q.types)
+		require.NoError(t, err)
+		var ids []string
+		for _, rec := range batch {
+			ids = append(ids, rec.ID)
+		}
+		return ids
+	}
+
+	assert.Error(t, q.Pause(ctx, Pause{}))
+	assert.Error(t, q.Pause(ctx, Pause{Type: "test", GroupID: "g1"}))
+
+	require.NoError(t, q.Pause(ctx, Pause{Type: "test", Reason: "incident"}))
+	assert.ElementsMatch(t, []string{"3"}, batchIDs())
+
+	require.NoError(t, q.Pause(ctx, Pause{GroupID: "g1"}))
+	assert.Empty(t, batchIDs())
+
+	// pauses are persisted and apply to all instances.
+	q2, err := newSQLQueue(&url.URL{Scheme: "sqlite3", Host: q.file}, q.types, q.handle)
+	require.NoError(t, err)
+	defer q2.Close()
+	pauses, err := q2.Pauses(ctx)
+	require.NoError(t, err)
+	require.Len(t, pauses, 2)
+	assert.Equal(t, "test", pauses[0].Type)
+	assert.Equal(t, "incident", pauses[0].Reason)
+	assert.Equal(t, "g1", pauses[1].GroupID)
+
+	require.NoError(t, q2.Resume(ctx, Pause{Type: "test"}))
+	assert.ElementsMatch(t, []string{"2"}, batchIDs())
+	assert.ErrorIs(t, q2.Resume(ctx, Pause{Type: "test"}), ErrNotFound)
+
+	require.NoError(t, q2.Resume(ctx, Pause{GroupID: "g1"}))
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, batchIDs())
+	assert.Equal(t, StatusPending, getTestItem(t, q, "1").Status)
+
+	// items fetched before a pause are not claimed after it.
+	batch, err := q.getBatch(ctx, q.types)
+	require.NoError(t, err)
+	require.NotEmpty(t, batch)
+	rec := batch[0]
+	require.NoError(t, q.Pause(ctx, Pause{GroupID: rec.GroupID}))
+	claimed, err := q.claim(ctx, &rec)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, StatusPending, getTestItem(t, q, rec.ID).Status)
+}
+
+func TestSQLQueue_circuitBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	failing, invocations := true, 0
+	q := newTestQueue(t, HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		invocations++
+		if failing {
+			return nil, errors.New("downstream is down")
+		}
+		return nil, nil
+	}), CircuitBreaker("test", Breaker{
+		Window:      time.Minute,
+		Threshold:   0.5,
+		MinAttempts: 2,
+		Cooldown:    50 * time.Millisecond,
+	}), func(o *Options) { o.MaxAttempts = 5 })
+	pushTestItems(t, q,
+		Item{ID: "1", Type: "test"}, Item{ID: "2", Type: "test"},
+		Item{ID: "3", Type: "test"}, Item{ID: "4", Type: "test"},
+	)
+	breaker := func() BreakerState {
+		states, err := q.Breakers(ctx)
+		require.NoError(t, err)
+		require.Len(t, states, 1)
+		return states[0]
+	}
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "1"), q.handle))
+	assert.Equal(t, BreakerClosed, breaker().State, "below minimum attempts")
+
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "2"), q.handle))
+	state := breaker()
+	assert.Equal(t, BreakerOpen, state.State)
+	assert.Equal(t, 2, state.Attempts)
+	assert.Equal(t, 2, state.Failures)
+	assert.Equal(t, state.OpenedAt.Add(50*time.Millisecond), state.ProbeAt)
+
+	// items are held without consuming attempts.
+	batch, err := q.getBatch(ctx, q.types)
+	require.NoError(t, err)
+	assert.Empty(t, batch)
+	require.NoError(t, q.processRecord(ctx, getTestItem(t, q, "3"), q.handle))
+	assert.Equal(t, 2, invocations)
+	assert.Equal(t, StatusPending, getTestItem(t, q, "3").Status)
+	assert.Equal(t, 0, getTestItem(t, q, "3").Attempts)
+
+	require.NoError(t, q.probeBreakers(ctx))
+	assert.Equal(t, 2, invocations, "must not probe before cooldown")
+
+	// failed probe opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, q.probeBreakers(ctx))
+	assert.Equal(t, 3, invocations)
+	assert.Equal(t, BreakerOpen, breaker().State)
+	assert.True(t, breaker().OpenedAt.After(state.OpenedAt))
+
+	// successful probe closes it and earlier failures are forgotten.
+	failing = false
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, q.probeBreakers(ctx))
+	assert.Equal(t, 4, invocations)
+	state = breaker()
+	assert.Equal(t, BreakerClosed, state.State)
+	assert.Equal(t, 0, state.Attempts)
+
+	pushTestItems(t, q, Item{ID: "5", Type: "test"})
+	batch, err = q.getBatch(ctx, q.types)
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	assert.Equal(t, "5", batch[0].ID)
+}
+
+func TestSQLQueue_circuitBreaker_probe(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	invocations := 0
+	h := HandlerFn(func(ctx context.Context, item Item) ([]byte, error) {
+		mu.Lock()
+		invocations++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	})
+	b := CircuitBreaker("test", Breaker{Window: time.Minute, Threshold: 0.5, Cooldown: time.Minute})
+	q := newTestQueue(t, h, b)
+	other, err := newSQLQueue(&url.URL{Scheme: "sqlite3", Host: q.file}, []string{"test"}, h, b)
+	require.NoError(t, err)
+	defer other.Close()
+
+	openBreaker := func() {
+		past := time.Now().Add(-time.Hour).UTC()
+		_, err := q.db.Exec(`INSERT INTO breakers (type, state, opened_at, updated_at) VALUES ('test', 'OPEN', ?, ?)
+			ON CONFLICT (type) DO UPDATE SET state='OPEN', opened_at=excluded.opened_at, updated_at=excluded.updated_at`, past, past)
+		require.NoError(t, err)
+	}
+
+	// only one of the instances racing to probe executes an item.
+	openBreaker()
+	pushTestItems(t, q, Item{ID: "1", Type: "test"}, Item{ID: "2", Type: "test"})
+
+	var wg sync.WaitGroup
+	for _, inst := range []*sqlQueue{q, other} {
+		wg.Add(1)
+		go func(inst *sqlQueue) {
+			defer wg.Done()
+			assert.NoError(t, inst.probeBreakers(ctx))
+		}(inst)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, invocations)
+
+	states, err := q.Breakers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, BreakerClosed, states[0].State)
+
+	// with nothing to probe, the breaker waits for another cooldown.
+	_, err = q.DeleteAll(ctx, Filter{Type: "test"})
+	require.NoError(t, err)
+	openBreaker()
+	require.NoError(t, q.probeBreakers(ctx))
+
+	states, err = q.Breakers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, BreakerOpen, states[0].State)
+	assert.True(t, states[0].ProbeAt.After(time.Now()))
+
+	rec, err := getBreaker(ctx, q.db, "test")
+	require.NoError(t, err)
+	require.NoError(t, other.probeBreakers(ctx))
+	after, err := getBreaker(ctx, q.db, "test")
+	require.NoError(t, err)
+	assert.Equal(t, rec.UpdatedAt, after.UpdatedAt, "open breaker must not be touched before cooldown")
+}
@@ -0,0 +1,561 @@
+package genie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Run starts the worker loop that fetches next item from the queue and applies
+// the given func. Runs until context is cancelled. fn can return nil, ErrFail,
+// ErrSkipped to move to DONE, FAILED or SKIPPED terminal statuses directly. If
+// fn returns any other error, it will remain in PENDING state and will be retried
+// after sometime. Once ctx is cancelled, no new items are picked up and the
+// in-flight item is given up to DrainTimeout to finish before Run returns.
+// Due schedules are fired and finalizers registered with the queue are
+// invoked by Run as groups finish. Open circuit breakers are probed with a
+// single item once their cooldown passes. Items held past their deadline
+// (e.g., by a pause) are expired.
+func (q *sqlQueue) Run(ctx context.Context) error {
+	workCtx, cancel := drainContext(ctx, q.opts.DrainTimeout)
+	defer cancel()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-timer.C:
+			timer.Reset(q.opts.PollInt)
+
+			if err := q.fireSchedules(workCtx); err != nil {
+				log.Printf("failed to fire schedules: %v", err)
+			}
+
+			if err := q.finalizeGroups(workCtx); err != nil {
+				log.Printf("failed to finalize groups: %v", err)
+			}
+
+			if err := q.probeBreakers(workCtx); err != nil {
+				log.Printf("failed to probe circuit breakers: %v", err)
+			}
+
+			if err := q.expireOverdue(workCtx); err != nil {
+				log.Printf("failed to expire overdue items: %v", err)
+			}
+
+			records, err := q.getBatch(ctx, q.types)
+			if err != nil {
+				log.Printf("failed to read next batch: %v", err)
+			} else if len(records) == 0 {
+				continue
+			}
+
+			for _, rec := range records {
+				if ctx.Err() != nil {
+					// shutdown requested. leave the rest for next run.
+					return nil
+				}
+
+				if err := q.processRecord(workCtx, rec, q.handle); err != nil {
+					log.Printf("failed to process '%s': %v", rec.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// getBatch returns the next items due for execution. Items of types and
+// groups that are paused or out of rate limit tokens, and items of types
+// whose circuit breaker is not closed are not fetched.
+func (q *sqlQueue) getBatch(ctx context.Context, supported []string) ([]sqlQueueItem, error) {
+	return q.selectDue(ctx, supported, false)
+}
+
+// selectDue returns the items due for execution as described in getBatch.
+// If probing, circuit breakers are ignored and at most one item is returned.
+func (q *sqlQueue) selectDue(ctx context.Context, supported []string, probing bool) ([]sqlQueueItem, error) {
+	selectQuery := `SELECT * FROM queue
+		WHERE ((status='PENDING' AND next_attempt_at <= ?) OR (status='RUNNING' AND lease_expires_at < ?))
+		  AND type IN (?) AND ` + keyAvailable + `
+		  AND type NOT IN (SELECT type FROM pauses WHERE type != '')
+		  AND group_id NOT IN (SELECT group_id FROM pauses WHERE group_id != '')`
+
+	limit := 10
+	if probing {
+		limit = 1
+	} else {
+		selectQuery += ` AND type NOT IN (SELECT type FROM breakers WHERE state != 'CLOSED')`
+	}
+
+	limitedTypes, limitedGroups, err := q.exhaustedLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Now().UTC()
+	params := []interface{}{t, t, supported, t, q.opts.KeyConcurrency}
+	if len(limitedTypes) > 0 {
+		selectQuery += ` AND type NOT IN (?)`
+		params = append(params, limitedTypes)
+	}
+	if len(limitedGroups) > 0 {
+		selectQuery += ` AND group_id NOT IN (?)`
+		params = append(params, limitedGroups)
+	}
+	selectQuery += fmt.Sprintf(` ORDER BY next_attempt_at LIMIT %d;`, limit)
+
+	query, args, err := sqlx.In(selectQuery, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []sqlQueueItem
+	err = q.db.SelectContext(ctx, &records, query, args...)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// keyAvailable is the condition on an item (in 'queue') that its concurrency
+// key is not saturated. Items whose lease has expired are not counted. Takes
+// the current time and the key concurrency as arguments.
+const keyAvailable = `(queue.concurrency_key IS NULL OR (
+		SELECT count(*) FROM queue r
+		WHERE r.concurrency_key = queue.concurrency_key AND r.id != queue.id
+		  AND r.status = 'RUNNING' AND r.lease_expires_at >= ?
+	) < ?)`
+
+// claim marks the pending item RUNNING with a lease owned by this worker.
+// A token is taken from each rate limit that applies to the item along with
+// the claim. Returns false if the item was claimed by another worker or is
+// not due anymore, if its type or group was paused, if its concurrency key
+// is saturated or a rate limit would be exceeded, or if the circuit breaker
+// of its type holds it. rec is reloaded once claimed since it may have
+// changed after it was fetched.
+func (q *sqlQueue) claim(ctx context.Context, rec *sqlQueueItem) (bool, error) {
+	const claimQuery = `UPDATE queue
+		SET status='RUNNING', lease_owner=?, lease_expires_at=?, updated_at=?
+		WHERE id=? AND status='PENDING' AND next_attempt_at <= ?
+		  AND ` + keyAvailable + ` AND NOT ` + breakerHolds + ` AND NOT ` + pauseHolds
+
+	tx, err := q.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	t := time.Now().UTC()
+	expiry := t.Add(q.opts.LeaseTimeout)
+	n, err := execCount(ctx, tx, claimQuery, q.opts.WorkerID, expiry, t, rec.ID, t,
+		t, q.opts.KeyConcurrency, q.opts.WorkerID)
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if err := tx.GetContext(ctx, rec, `SELECT * FROM queue WHERE id=?`, rec.ID); err != nil {
+		return false, err
+	}
+
+	for key, limit := range q.rateLimitsOf(*rec) {
+		if ok, err := takeToken(ctx, tx, key, limit, t); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// heartbeat extends the lease on the item periodically until the returned
+// func is called. If the lease cannot be extended because the item is no
+// longer running under this worker (e.g., it was cancelled), cancel is
+// invoked to stop the handler.
+func (q *sqlQueue) heartbeat(ctx context.Context, rec sqlQueueItem, cancel context.CancelFunc) (stop func()) {
+	const extendQuery = `UPDATE queue SET lease_expires_at=?
+		WHERE id=? AND status='RUNNING' AND lease_owner=?`
+
+	return q.keepAlive(ctx, cancel, func(ctx context.Context, expiry time.Time) (int, error) {
+		n, err := execCount(ctx, q.db, extendQuery, expiry, rec.ID, rec.LeaseOwner)
+		if err != nil {
+			return 0, fmt.Errorf("item '%s': %w", rec.ID, err)
+		}
+		return n, nil
+	})
+}
+
+// keepAlive invokes extend with the new lease expiry every LeaseTimeout/3
+// until the returned func is called. If extend updates nothing, the lease
+// is considered lost and cancel is invoked.
+func (q *sqlQueue) keepAlive(ctx context.Context, cancel context.CancelFunc,
+	extend func(ctx context.Context, expiry time.Time) (int, error)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(q.opts.LeaseTimeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				n, err := extend(detach(ctx), time.Now().Add(q.opts.LeaseTimeout).UTC())
+				if err != nil {
+					log.Printf("failed to extend lease: %v", err)
+				} else if n == 0 {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (q *sqlQueue) processRecord(ctx context.Context, rec sqlQueueItem, h Handler) error {
+	if rec.Deadline.Valid && !time.Now().Before(rec.Deadline.Time) {
+		return q.expire(ctx, rec)
+	}
+
+	if rec.Status == StatusRunning {
+		if reclaimed, err := q.reclaim(ctx, &rec); err != nil || !reclaimed {
+			return err
+		}
+	}
+
+	if claimed, err := q.claim(ctx, &rec); err != nil {
+		return err
+	} else if !claimed {
+		return nil
+	}
+
+	fnCtx, cancel := context.WithTimeout(ctx, q.opts.FnTimeout)
+	defer cancel()
+
+	item := rec.Item()
+	children, err := q.childrenOf(ctx, rec.ID)
+	if err != nil {
+		return err
+	}
+	item.Children = children
+
+	exec := newExecution(item, q.opts)
+	exec.saveProgress = func(ctx context.Context, p Progress) error {
+		const query = `UPDATE queue SET progress=?, progress_message=? WHERE id=? AND status='RUNNING'`
+		_, err := q.db.ExecContext(ctx, query, p.Fraction, p.Message, rec.ID)
+		return err
+	}
+	exec.saveCheckpoint = func(ctx context.Context, state []byte) error {
+		const query = `UPDATE queue SET checkpoint=? WHERE id=? AND status='RUNNING' AND lease_owner=?`
+		n, err := execCount(ctx, q.db, query, state, rec.ID, rec.LeaseOwner)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			return ErrInvalidStatus
+		}
+		return nil
+	}
+	exec.prepareChildren = func(ctx context.Context, items []Item) ([]Item, error) {
+		return q.prepareChildren(ctx, rec, items)
+	}
+	fnCtx = withExecution(fnCtx, exec)
+
+	stopHeartbeat := q.heartbeat(ctx, rec, cancel)
+	startedAt := time.Now().UTC()
+	result, fnErr := safeHandle(fnCtx, h, item)
+	stopHeartbeat()
+	rec.Attempts++
+
+	var panicErr *PanicError
+	panicked := errors.As(fnErr, &panicErr)
+	if panicked {
+		metrics.Add(metricPanics, 1)
+		log.Printf("handler panicked for '%s': %v", rec.ID, panicErr.Value)
+	}
+
+	spawned := exec.spawned()
+	if fnErr == nil {
+		rec.Status = StatusDone
+		if len(spawned) > 0 {
+			rec.Status = StatusWaiting
+		}
+		rec.Result = sql.NullString{
+			Valid:  true,
+			String: string(result),
+		}
+	} else {
+		if errors.Is(fnErr, ErrFail) || rec.Attempts >= rec.MaxAttempts ||
+			(panicked && q.opts.PanicPolicy == PanicFail) {
+			rec.Status = StatusFailed
+		} else if errors.Is(fnErr, ErrSkip) {
+			rec.Status = StatusSkipped
+		} else {
+			rec.Status = StatusPending
+		}
+
+		rec.NextAttemptAt = time.Now().Add(q.opts.RetryBackoff).UTC()
+		if rec.Status == StatusPending && rec.Deadline.Valid && rec.NextAttemptAt.After(rec.Deadline.Time) {
+			rec.Status = StatusExpired
+		}
+		rec.LastError = sql.NullString{
+			Valid:  true,
+			String: fnErr.Error(),
+		}
+	}
+
+	rec.UpdatedAt = time.Now().UTC()
+	if p := exec.latestProgress(); p != nil {
+		rec.Progress = p.Fraction
+		rec.ProgressMessage = p.Message
+	}
+
+	att := sqlAttempt{
+		ItemID:     rec.ID,
+		Number:     rec.Attempts,
+		WorkerID:   q.opts.WorkerID,
+		StartedAt:  startedAt,
+		EndedAt:    rec.UpdatedAt,
+		DurationMS: rec.UpdatedAt.Sub(startedAt).Milliseconds(),
+		Outcome:    rec.Status,
+		Error:      rec.LastError,
+		ResultSize: len(result),
+		Log:        sql.NullString{Valid: true, String: exec.logs.String()},
+	}
+	if fnErr == nil {
+		att.Error = sql.NullString{}
+	}
+
+	// outcome must be persisted even if ctx was cancelled while draining.
+	if rec.Status != StatusWaiting {
+		spawned = nil
+	}
+	outcome, err := q.saveOutcome(detach(ctx), rec, att, spawned)
+	if err != nil {
+		return err
+	}
+
+	if err := q.tripBreaker(detach(ctx), rec.Type, outcome, fnErr); err != nil {
+		log.Printf("failed to update circuit breaker of '%s': %v", rec.Type, err)
+	}
+
+	metrics.Add(metricProcessed, 1)
+	switch outcome {
+	case StatusDone:
+		metrics.Add(metricDone, 1)
+	case StatusFailed:
+		metrics.Add(metricFailed, 1)
+	case StatusSkipped:
+		metrics.Add(metricSkipped, 1)
+	case StatusCancelled:
+		metrics.Add(metricCancelled, 1)
+	case StatusWaiting:
+		metrics.Add(metricWaiting, 1)
+	case StatusExpired:
+		metrics.Add(metricExpired, 1)
+	default:
+		metrics.Add(metricRetried, 1)
+	}
+	return nil
+}
+
+// expire moves the item picked up past its deadline to EXPIRED without
+// invoking the handler. Nothing is done if the item was claimed by another
+// worker or changed in the meantime.
+func (q *sqlQueue) expire(ctx context.Context, rec sqlQueueItem) error {
+	const expireQuery = `UPDATE queue
+		SET status='EXPIRED', last_error=?, lease_owner=NULL, lease_expires_at=NULL, updated_at=?
+		WHERE id=? AND (status='PENDING' OR (status='RUNNING' AND lease_expires_at < ?))`
+
+	t := time.Now().UTC()
+	lastErr := fmt.Sprintf("deadline %s exceeded", rec.Deadline.Time.Format(time.RFC3339))
+	n, err := q.withTx(ctx, t, func(tx *sqlx.Tx) (int, error) {
+		return execCount(ctx, tx, expireQuery, lastErr, t, rec.ID, t)
+	})
+	if err != nil {
+		return err
+	} else if n > 0 {
+		metrics.Add(metricExpired, 1)
+	}
+	return nil
+}
+
+// expireOverdue moves the PENDING and BLOCKED items whose deadline passed
+// while they were held (e.g., by a pause, an open circuit breaker or their
+// parents) to EXPIRED.
+func (q *sqlQueue) expireOverdue(ctx context.Context) error {
+	const expireQuery = `UPDATE queue
+		SET status='EXPIRED', last_error='deadline exceeded', updated_at=?
+		WHERE deadline IS NOT NULL AND deadline <= ? AND status IN ('PENDING', 'BLOCKED')`
+
+	t := time.Now().UTC()
+	n, err := q.withTx(ctx, t, func(tx *sqlx.Tx) (int, error) {
+		return execCount(ctx, tx, expireQuery, t, t)
+	})
+	if err != nil {
+		return err
+	}
+	metrics.Add(metricExpired, int64(n))
+	return nil
+}
+
+// reclaim counts the attempt of the item whose lease expired (e.g., the
+// worker crashed) as failed and moves it back to PENDING, or to FAILED if
+// it has no attempts left. Returns true if the item can be claimed again.
+// Nothing is done if the item was reclaimed by another worker or changed
+// in the meantime.
+func (q *sqlQueue) reclaim(ctx context.Context, rec *sqlQueueItem) (bool, error) {
+	const reclaimQuery = `UPDATE queue
+		SET status=CASE WHEN attempts+1 >= max_attempts THEN 'FAILED' ELSE 'PENDING' END,
+		    attempts=attempts+1, last_error=?, next_attempt_at=?,
+		    lease_owner=NULL, lease_expires_at=NULL, updated_at=?
+		WHERE id=? AND status='RUNNING' AND lease_owner=? AND lease_expires_at < ?`
+
+	t := time.Now().UTC()
+	lastErr := fmt.Sprintf("lease of worker '%s' expired", rec.LeaseOwner.String)
+	att := sqlAttempt{
+		ItemID:     rec.ID,
+		WorkerID:   rec.LeaseOwner.String,
+		StartedAt:  rec.UpdatedAt, // set when the lost attempt claimed the item.
+		EndedAt:    rec.LeaseExpiresAt.Time,
+		DurationMS: rec.LeaseExpiresAt.Time.Sub(rec.UpdatedAt).Milliseconds(),
+		Error:      sql.NullString{Valid: true, String: lastErr},
+	}
+
+	n, err := q.withTx(ctx, t, func(tx *sqlx.Tx) (int, error) {
+		n, err := execCount(ctx, tx, reclaimQuery, lastErr, t, t, rec.ID, rec.LeaseOwner, t)
+		if err != nil || n == 0 {
+			return 0, err
+		}
+
+		if err := tx.GetContext(ctx, rec, `SELECT * FROM queue WHERE id=?`, rec.ID); err != nil {
+			return 0, err
+		}
+		att.Number, att.Outcome = rec.Attempts, rec.Status
+		_, err = namedExec(ctx, tx, insertAttemptQuery, att)
+		return n, err
+	})
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if err := q.tripBreaker(detach(ctx), rec.Type, rec.Status, errors.New(lastErr)); err != nil {
+		log.Printf("failed to update circuit breaker of '%s': %v", rec.Type, err)
+	}
+
+	metrics.Add(metricProcessed, 1)
+	if rec.Status == StatusFailed {
+		metrics.Add(metricFailed, 1)
+		return false, nil
+	}
+	metrics.Add(metricRetried, 1)
+	return true, nil
+}
+
+// insertAttemptQuery records an attempt in the history of the item.
+const insertAttemptQuery = `INSERT INTO attempts
+	(item_id, attempt, worker_id, started_at, ended_at, duration_ms, outcome, error, result_size, log)
+	VALUES (:item_id, :attempt, :worker_id, :started_at, :ended_at, :duration_ms, :outcome, :error, :result_size, :log)`
+
+// saveOutcome updates the item with the outcome of the attempt, pushes the
+// children spawned and records the attempt in its history. If the item was
+// cancelled while running, the result and children are discarded and the
+// attempt is recorded as cancelled. Returns the final outcome of the attempt.
+func (q *sqlQueue) saveOutcome(ctx context.Context, rec sqlQueueItem, att sqlAttempt, children []Item) (string, error) {
+	const updateQuery = `UPDATE queue
+		SET status=:status, 
+		    last_error=:last_error, 
+		    next_attempt_at=:next_attempt_at, 
+		    attempts=:attempts,
+		    updated_at=:updated_at,
+		    result=:result,
+		    progress=:progress,
+		    progress_message=:progress_message,
+		    lease_owner=NULL,
+		    lease_expires_at=NULL
+		WHERE id=:id AND status='RUNNING' AND lease_owner=:lease_owner`
+
+	_, err := q.withTx(ctx, rec.UpdatedAt, func(tx *sqlx.Tx) (int, error) {
+		if n, err := namedExec(ctx, tx, updateQuery, rec); err != nil {
+			return 0, err
+		} else if n == 0 {
+			var status string
+			if err := tx.GetContext(ctx, &status, `SELECT status FROM queue WHERE id=?`, rec.ID); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return 0, errors.New("item was deleted while running, discarded result")
+				}
+				return 0, err
+			} else if status != StatusCancelled {
+				return 0, fmt.Errorf("item moved to %s while running, discarded result", status)
+			}
+			att.Outcome = StatusCancelled
+			children = nil
+		}
+
+		for _, child := range children {
+			opts := PushOptions{OnConflict: ConflictIgnore}
+			if _, _, err := q.pushItem(ctx, tx, opts, child, rec.ID, rec.UpdatedAt); err != nil {
+				return 0, fmt.Errorf("failed to push child '%s': %w", child.ID, err)
+			}
+		}
+
+		_, err := namedExec(ctx, tx, insertAttemptQuery, att)
+		return 0, err
+	})
+	return att.Outcome, err
+}
+
+// childrenOf returns the outcomes of the items spawned by the item.
+func (q *sqlQueue) childrenOf(ctx context.Context, id string) ([]ChildOutcome, error) {
+	const query = `SELECT id, type, status, coalesce(result, '') AS result, coalesce(last_error, '') AS last_error
+		FROM queue WHERE parent_id=? ORDER BY created_at, id`
+
+	var children []ChildOutcome
+	if err := q.db.SelectContext(ctx, &children, query, id); err != nil {
+		return nil, err
+	}
+	return children, nil
+}
+
+// prepareChildren applies the interceptors and sanitization to the items
+// spawned by the parent. Children inherit the group of the parent unless
+// set. Returns error if any of the children is invalid.
+func (q *sqlQueue) prepareChildren(ctx context.Context, parent sqlQueueItem, items []Item) ([]Item, error) {
+	for i := range items {
+		if items[i].GroupID == "" {
+			items[i].GroupID = parent.GroupID
+		}
+	}
+
+	results, candidates := preparePush(ctx, q.opts.Interceptors, q.handle, items)
+	for _, res := range results {
+		if res.Status == PushInvalid {
+			return nil, fmt.Errorf("child '%s' is invalid: %s", res.ID, res.Reason)
+		}
+	}
+
+	children := make([]Item, len(candidates))
+	for i, c := range candidates {
+		children[i] = c.Item
+	}
+	return children, nil
+}
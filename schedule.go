@@ -0,0 +1,175 @@
+package genie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MissedRunPolicy decides what happens to the runs of a schedule that were
+// missed, e.g., because no worker was running when they were due.
+type MissedRunPolicy string
+
+// Missed run policies supported by schedules.
+const (
+	MissedRunSkip    MissedRunPolicy = "skip"     // enqueue only the latest missed run.
+	MissedRunCatchUp MissedRunPolicy = "catch_up" // enqueue every missed run.
+)
+
+// maxCatchUp is the maximum number of missed runs enqueued at once.
+const maxCatchUp = 100
+
+// Schedule enqueues an item of the type whenever the cron expression is
+// due. Payload and GroupID are text/template strings rendered with the
+// ScheduleRun of each run, e.g., "daily-{{.Time.Format \"2006-01-02\"}}".
+// Items are assigned the ID '<schedule-id>@<unix-time-of-run>'.
+type Schedule struct {
+	ID         string          `json:"id"`
+	Cron       string          `json:"cron"`
+	Timezone   string          `json:"timezone,omitempty"`
+	Type       string          `json:"type"`
+	Payload    string          `json:"payload"`
+	GroupID    string          `json:"group_id,omitempty"`
+	MissedRuns MissedRunPolicy `json:"missed_runs,omitempty"`
+	Disabled   bool            `json:"disabled,omitempty"`
+
+	// Metadata maintained by the queue. These are ignored by PutSchedule.
+	NextRunAt time.Time `json:"next_run_at"`
+	LastRunAt time.Time `json:"last_run_at,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ScheduleRun is the data available to the Payload and GroupID templates
+// of a schedule.
+type ScheduleRun struct {
+	ScheduleID string
+	Time       time.Time // time the run was due, in the schedule timezone.
+}
+
+// compiledSchedule is a validated schedule ready for computing runs.
+type compiledSchedule struct {
+	cron    *cronSpec
+	loc     *time.Location
+	payload *template.Template
+	groupID *template.Template
+}
+
+// compile validates the schedule, filling in the defaults.
+func (s *Schedule) compile() (*compiledSchedule, error) {
+	s.ID = strings.TrimSpace(s.ID)
+	s.Type = strings.TrimSpace(s.Type)
+	if s.ID == "" || s.Type == "" {
+		return nil, errors.New("schedule id and type must be set")
+	}
+
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	if s.MissedRuns == "" {
+		s.MissedRuns = MissedRunSkip
+	} else if s.MissedRuns != MissedRunSkip && s.MissedRuns != MissedRunCatchUp {
+		return nil, fmt.Errorf("unknown missed runs policy '%s'", s.MissedRuns)
+	}
+
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+
+	payload, err := template.New("payload").Parse(s.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload template: %w", err)
+	}
+
+	groupID, err := template.New("group_id").Parse(s.GroupID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group id template: %w", err)
+	}
+
+	return &compiledSchedule{cron: cron, loc: loc, payload: payload, groupID: groupID}, nil
+}
+
+// next returns the first run of the schedule after t.
+func (cs *compiledSchedule) next(t time.Time) time.Time {
+	return cs.cron.next(t.In(cs.loc))
+}
+
+// dueRuns returns the runs due in (after, now] as per the policy, and the
+// next run after now. Only the latest run is returned when skipping missed
+// runs, and up to maxCatchUp latest runs when catching up. Runs are looked
+// up from a window before now that is widened until it has enough runs, so
+// that a long outage does not walk every missed run since after.
+func (cs *compiledSchedule) dueRuns(s Schedule, after, now time.Time) ([]time.Time, time.Time) {
+	want := 1
+	if s.MissedRuns == MissedRunCatchUp {
+		want = maxCatchUp
+	}
+
+	next := cs.next(now)
+	first := cs.next(after)
+	if first.IsZero() || first.After(now) {
+		return nil, next
+	}
+
+	from := after
+	if period := cs.next(first).Sub(first); period > 0 {
+		for window := time.Duration(want) * period; now.Add(-window).After(after); window *= 2 {
+			if len(cs.runs(now.Add(-window), now, want)) >= want {
+				from = now.Add(-window)
+				break
+			}
+		}
+	}
+
+	runs := cs.runs(from, now, 0)
+	if len(runs) > want {
+		runs = runs[len(runs)-want:]
+	}
+	return runs, next
+}
+
+// runs returns up to limit runs in (from, to], or all if limit <= 0.
+func (cs *compiledSchedule) runs(from, to time.Time, limit int) []time.Time {
+	var runs []time.Time
+	for t := cs.next(from); !t.IsZero() && !t.After(to); t = cs.next(t) {
+		runs = append(runs, t)
+		if len(runs) == limit {
+			break
+		}
+	}
+	return runs
+}
+
+// item returns the item to be enqueued for the run of the schedule at t.
+func (cs *compiledSchedule) item(s Schedule, t time.Time) (Item, error) {
+	run := ScheduleRun{ScheduleID: s.ID, Time: t.In(cs.loc)}
+
+	var payload, groupID bytes.Buffer
+	if err := cs.payload.Execute(&payload, run); err != nil {
+		return Item{}, fmt.Errorf("failed to render payload: %w", err)
+	}
+	if err := cs.groupID.Execute(&groupID, run); err != nil {
+		return Item{}, fmt.Errorf("failed to render group id: %w", err)
+	}
+
+	item := Item{
+		ID:      fmt.Sprintf("%s@%d", s.ID, t.Unix()),
+		Type:    s.Type,
+		Payload: payload.String(),
+		GroupID: groupID.String(),
+	}
+	if item.GroupID == "" {
+		item.GroupID = s.ID
+	}
+	return item, nil
+}